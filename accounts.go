@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// heAccount is an entry of the `accounts` list in the solver config: the
+// credentials (and optionally the method and URL) to use for some zones.
+// Zones are either exact zone names ("example.com") or suffixes starting
+// with a dot (".example.com"), which match any zone below that domain.
+type heAccount struct {
+	Zones                []string   `json:"zones"`
+	Method               string     `json:"method"`
+	HeUrl                string     `json:"heUrl"`
+	CredentialsSecretRef secretRef  `json:"credentialsSecretRef"`
+	ApiKeySecretRef      secretRef  `json:"ApiKeySecretRef"`
+	CredentialProvider   string     `json:"credentialProvider"`
+	Exec                 execConfig `json:"exec"`
+}
+
+// selectAccount returns the account for the given zone. An exact zone name
+// wins over a suffix, and a longer suffix over a shorter one.
+func selectAccount(accounts []heAccount, zone string) (*heAccount, error) {
+
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	var best *heAccount
+	bestLen := -1
+
+	for i := range accounts {
+		for _, z := range accounts[i].Zones {
+			z = strings.ToLower(strings.TrimSuffix(z, "."))
+
+			matchLen := -1
+			if strings.HasPrefix(z, ".") {
+				if strings.HasSuffix(zone, z) {
+					matchLen = len(z)
+				}
+			} else if z == zone {
+				// longer than any suffix that can match the zone
+				matchLen = len(zone) + 1
+			}
+
+			if matchLen > bestLen {
+				best, bestLen = &accounts[i], matchLen
+			}
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("zone %v does not match any of the configured accounts", zone)
+	}
+	return best, nil
+}
+
+// withAccount returns a copy of the config with the settings of the given
+// account replacing the top-level ones
+func (cfg heProviderConfig) withAccount(account *heAccount) heProviderConfig {
+	if account.Method != "" {
+		cfg.Method = account.Method
+	}
+	if account.HeUrl != "" {
+		cfg.HeUrl = account.HeUrl
+	}
+	if account.CredentialProvider != "" {
+		cfg.CredentialProvider = account.CredentialProvider
+	}
+	cfg.CredentialsSecretRef = account.CredentialsSecretRef
+	cfg.ApiKeySecretRef = account.ApiKeySecretRef
+	if account.Exec.Plugin != "" || len(account.Exec.Args) > 0 {
+		cfg.Exec = account.Exec
+	}
+	cfg.Accounts = nil
+	return cfg
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectAccount(t *testing.T) {
+	accounts := []heAccount{
+		{Zones: []string{".example.com"}, Method: "suffix"},
+		{Zones: []string{"example.com", "example.org."}, Method: "exact"},
+		{Zones: []string{".sub.example.com"}, Method: "longer-suffix"},
+		{Zones: []string{"deep.sub.example.com"}, Method: "exact-deep"},
+	}
+
+	tests := []struct {
+		zone string
+		// the Method of the account expected, "" for no match
+		want string
+	}{
+		// an exact name wins over a suffix that also matches
+		{"example.com.", "exact"},
+		{"EXAMPLE.org", "exact"},
+		{"www.example.com", "suffix"},
+		// the longest suffix wins
+		{"sub.example.com", "suffix"},
+		{"a.sub.example.com", "longer-suffix"},
+		{"deep.sub.example.com.", "exact-deep"},
+		// a suffix only matches on a label boundary
+		{"notexample.com", ""},
+		{"example.net", ""},
+	}
+	for _, tt := range tests {
+		got, err := selectAccount(accounts, tt.zone)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%v: got account %v, want no match", tt.zone, got.Zones)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.zone, err)
+			continue
+		}
+		if got.Method != tt.want {
+			t.Errorf("%v: got account %v, want %v", tt.zone, got.Method, tt.want)
+		}
+	}
+}
+
+func TestWithAccount(t *testing.T) {
+	top := heProviderConfig{
+		Method:             "login",
+		HeUrl:              "https://dns.he.net/",
+		CredentialProvider: "exec",
+		Exec:               execConfig{Plugin: "vault", Args: []string{"--role", "dns"}},
+		Accounts:           []heAccount{{Zones: []string{"example.com"}}},
+		Fallback:           []fallbackConfig{{Method: "dynamic-dns"}},
+	}
+
+	tests := []struct {
+		name    string
+		account heAccount
+		want    heProviderConfig
+	}{
+		{
+			name:    "everything inherited",
+			account: heAccount{},
+			want: heProviderConfig{
+				Method:             "login",
+				HeUrl:              "https://dns.he.net/",
+				CredentialProvider: "exec",
+				Exec:               execConfig{Plugin: "vault", Args: []string{"--role", "dns"}},
+				Fallback:           []fallbackConfig{{Method: "dynamic-dns"}},
+			},
+		},
+		{
+			name: "everything overridden",
+			account: heAccount{
+				Method:             "dynamic-dns",
+				HeUrl:              "https://dyn.example/",
+				CredentialProvider: "secret",
+				ApiKeySecretRef:    secretRef{Name: "ddns"},
+			},
+			want: heProviderConfig{
+				Method:             "dynamic-dns",
+				HeUrl:              "https://dyn.example/",
+				CredentialProvider: "secret",
+				ApiKeySecretRef:    secretRef{Name: "ddns"},
+				// unused with the secret provider, like at the top level
+				Exec:     execConfig{Plugin: "vault", Args: []string{"--role", "dns"}},
+				Fallback: []fallbackConfig{{Method: "dynamic-dns"}},
+			},
+		},
+		{
+			name:    "own plugin",
+			account: heAccount{Exec: execConfig{Plugin: "other"}},
+			want: heProviderConfig{
+				Method:             "login",
+				HeUrl:              "https://dns.he.net/",
+				CredentialProvider: "exec",
+				Exec:               execConfig{Plugin: "other"},
+				Fallback:           []fallbackConfig{{Method: "dynamic-dns"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := top.withAccount(&tt.account); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
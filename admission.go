@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// admissionServer serves a ValidatingAdmissionWebhook for cert-manager
+// Issuers and ClusterIssuers, rejecting the ones whose "he" solvers have a
+// config that would fail at challenge time.
+type admissionServer struct {
+	config *configStore
+}
+
+// startAdmissionServer starts the admission webhook if ADMISSION_WEBHOOK_ADDR
+// is set (eg, ":8443"). It uses the certificate and key in
+// ADMISSION_TLS_CERT_FILE and ADMISSION_TLS_KEY_FILE (by default the ones
+// also used by the main webhook server), reloading them on each connection so
+// that renewed certificates are picked up.
+func startAdmissionServer(config *configStore) {
+
+	addr := os.Getenv("ADMISSION_WEBHOOK_ADDR")
+	if addr == "" {
+		return
+	}
+	certFile := envOrDefault("ADMISSION_TLS_CERT_FILE", "/tls/tls.crt")
+	keyFile := envOrDefault("ADMISSION_TLS_KEY_FILE", "/tls/tls.key")
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate", &admissionServer{config: config})
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+				if err != nil {
+					return nil, err
+				}
+				return &cert, nil
+			},
+		},
+	}
+
+	go func() {
+		klog.InfoS("Starting admission webhook", "addr", addr)
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			klog.ErrorS(err, "Admission webhook stopped")
+			os.Exit(1)
+		}
+	}()
+}
+
+func (a *admissionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("invalid AdmissionReview: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+
+	problems, err := a.validateIssuer(review.Request.Object.Raw, review.Request.Namespace)
+	if err != nil {
+		problems = []string{err.Error()}
+	}
+	if len(problems) > 0 {
+		klog.InfoS("Rejecting issuer", "kind", review.Request.Kind.Kind, "namespace", review.Request.Namespace, "name", review.Request.Name, "problems", problems)
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: strings.Join(problems, "; "),
+		}
+	}
+
+	review.Response = response
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		klog.ErrorS(err, "Error writing admission response")
+	}
+}
+
+// validateIssuer runs the solver config validation on every webhook solver
+// of the (Cluster)Issuer that refers to us. namespace is the issuer's
+// namespace, empty for ClusterIssuers.
+func (a *admissionServer) validateIssuer(raw []byte, namespace string) ([]string, error) {
+
+	// cert-manager sends the challenges of ClusterIssuers with its cluster
+	// resource namespace
+	if namespace == "" {
+		namespace = clusterResourceNamespace()
+	}
+
+	// Issuer and ClusterIssuer have the same spec
+	issuer := cmapi.Issuer{}
+	if err := json.Unmarshal(raw, &issuer); err != nil {
+		return nil, fmt.Errorf("cannot decode issuer: %v", err)
+	}
+	if issuer.Spec.ACME == nil {
+		return nil, nil
+	}
+
+	settings := a.config.Get()
+	problems := []string{}
+
+	for i, solver := range issuer.Spec.ACME.Solvers {
+		if solver.DNS01 == nil || solver.DNS01.Webhook == nil {
+			continue
+		}
+		webhook := solver.DNS01.Webhook
+		if webhook.GroupName != settings.GroupName || webhook.SolverName != (&heProviderSolver{}).Name() {
+			continue
+		}
+
+		path := fmt.Sprintf("spec.acme.solvers[%d].dns01.webhook.config", i)
+		if err := validateSolverConfig(webhook.Config, settings, namespace); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", path, err))
+		}
+	}
+	return problems, nil
+}
+
+// validateSolverConfig runs the same checks initConfig does, for every
+// account and fallback in the config
+func validateSolverConfig(raw *extapi.JSON, settings *webhookConfig, namespace string) error {
+
+	cfg, err := loadConfig(raw, settings.Method)
+	if err != nil {
+		return err
+	}
+
+	accounts := []heProviderConfig{cfg}
+	if len(cfg.Accounts) > 0 {
+		accounts = nil
+		for i := range cfg.Accounts {
+			accounts = append(accounts, cfg.withAccount(&cfg.Accounts[i]))
+		}
+	}
+	configs := []heProviderConfig{}
+	for _, c := range accounts {
+		configs = append(configs, c)
+		// the fallbacks run with the credential provider of the account
+		for i := range c.Fallback {
+			configs = append(configs, c.fallbackConfig(i))
+		}
+	}
+
+	problems := configProblems{}
+	for _, c := range configs {
+		if _, err := resolveConfig(c, settings, namespace); err != nil {
+			problems.add("", "%v", err)
+		}
+		if err := settings.checkCredentialProvider(c.CredentialProvider, namespace); err != nil {
+			problems.add("", "%v", err)
+		}
+	}
+	return problems.err()
+}
+
+// clusterResourceNamespace returns the namespace cert-manager uses for the
+// challenges of ClusterIssuers, its --cluster-resource-namespace, given in
+// CLUSTER_RESOURCE_NAMESPACE
+func clusterResourceNamespace() string {
+	return envOrDefault("CLUSTER_RESOURCE_NAMESPACE", "cert-manager")
+}
+
+func envOrDefault(name string, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cmacme "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmapi "github.com/cert-manager/cert-manager/pkg/apis/certmanager/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// issuerReview returns an AdmissionReview for an Issuer with a webhook
+// solver for each of the given groupName, solverName and config triples
+func issuerReview(t *testing.T, namespace string, solvers ...[3]string) []byte {
+	t.Helper()
+
+	issuer := cmapi.Issuer{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "cert-manager.io/v1", Kind: "Issuer"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "letsencrypt"},
+		Spec: cmapi.IssuerSpec{IssuerConfig: cmapi.IssuerConfig{ACME: &cmacme.ACMEIssuer{
+			Server: "https://acme.example/directory",
+		}}},
+	}
+	for _, s := range solvers {
+		issuer.Spec.ACME.Solvers = append(issuer.Spec.ACME.Solvers, cmacme.ACMEChallengeSolver{
+			DNS01: &cmacme.ACMEChallengeSolverDNS01{Webhook: &cmacme.ACMEIssuerDNS01ProviderWebhook{
+				GroupName:  s[0],
+				SolverName: s[1],
+				Config:     &extapi.JSON{Raw: []byte(s[2])},
+			}},
+		})
+	}
+	raw, err := json.Marshal(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "review-uid",
+			Kind:      metav1.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Issuer"},
+			Namespace: namespace,
+			Name:      "letsencrypt",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	data, err := json.Marshal(review)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestAdmissionServer(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	config, err := newConfigStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &admissionServer{config: config}
+	t.Setenv("CLUSTER_RESOURCE_NAMESPACE", "platform")
+
+	tests := []struct {
+		name string
+		body []byte
+		// 0 if the review is expected to be answered
+		wantStatus  int
+		wantAllowed bool
+		wantMessage []string
+	}{
+		{
+			name:        "valid config",
+			body:        issuerReview(t, "certs", [3]string{"acme.example.com", "he", `{"method": "login", "credentialsSecretRef": {"name": "he"}}`}),
+			wantAllowed: true,
+		},
+		{
+			name: "invalid config",
+			body: issuerReview(t, "certs",
+				[3]string{"acme.example.com", "he", `{"method": "login"}`},
+				[3]string{"acme.example.com", "he", `{"metod": "login", "apiKeySecretRef": {"name": "ddns"}}`},
+			),
+			wantMessage: []string{
+				"spec.acme.solvers[1].dns01.webhook.config",
+				`unknown field "metod"`,
+				"apiKeySecretRef: cannot be used with the login method",
+			},
+		},
+		{
+			name:        "provider not allowed in the namespace",
+			body:        issuerReview(t, "tenant", [3]string{"acme.example.com", "he", `{"credentialProvider": "env"}`}),
+			wantMessage: []string{"the env credential provider is not allowed for issuers in namespace tenant"},
+		},
+		{
+			name:        "cluster issuer, provider not allowed in the cluster resource namespace",
+			body:        issuerReview(t, "", [3]string{"acme.example.com", "he", `{"credentialProvider": "env"}`}),
+			wantMessage: []string{"the env credential provider is not allowed for issuers in namespace platform"},
+		},
+		{
+			name: "other solvers",
+			body: issuerReview(t, "certs",
+				[3]string{"acme.other.com", "he", `{"anything": true}`},
+				[3]string{"acme.example.com", "cloudflare", `{"anything": true}`},
+			),
+			wantAllowed: true,
+		},
+		{
+			name:        "no solvers",
+			body:        issuerReview(t, "certs"),
+			wantAllowed: true,
+		},
+		{
+			name:       "malformed body",
+			body:       []byte(`{"request": `),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no request",
+			body:       []byte(`{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "malformed issuer",
+			body:        []byte(`{"request": {"uid": "review-uid", "object": {"spec": "nope"}}}`),
+			wantMessage: []string{"cannot decode issuer"},
+		},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(tt.body)))
+
+		if tt.wantStatus != 0 {
+			if w.Code != tt.wantStatus {
+				t.Errorf("%v: got status %v, want %v", tt.name, w.Code, tt.wantStatus)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: got status %v: %v", tt.name, w.Code, w.Body.String())
+			continue
+		}
+
+		review := admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+			t.Errorf("%v: cannot decode response: %v", tt.name, err)
+			continue
+		}
+		if review.Response == nil || review.Response.UID != "review-uid" {
+			t.Errorf("%v: response missing or for another request: %+v", tt.name, review.Response)
+			continue
+		}
+		if review.Response.Allowed != tt.wantAllowed {
+			t.Errorf("%v: got allowed=%v, want %v (%+v)", tt.name, review.Response.Allowed, tt.wantAllowed, review.Response.Result)
+			continue
+		}
+		if tt.wantAllowed {
+			continue
+		}
+		if review.Response.Result == nil || review.Response.Result.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%v: unexpected result %+v", tt.name, review.Response.Result)
+			continue
+		}
+		for _, want := range tt.wantMessage {
+			if !strings.Contains(review.Response.Result.Message, want) {
+				t.Errorf("%v: got message %q, want it to mention %q", tt.name, review.Response.Result.Message, want)
+			}
+		}
+	}
+}
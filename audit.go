@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+// auditLogs holds the audit log selected by the auditLog setting, reopening
+// it when the setting changes
+type auditLogs struct {
+	mu   sync.Mutex
+	path string
+	log  utils.AuditLog
+	file *os.File
+}
+
+// get returns the audit log for the given setting: nil if empty, the
+// webhook's output if "stdout", and a JSON-lines file otherwise
+func (a *auditLogs) get(path string) utils.AuditLog {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if path == a.path && (a.log != nil || path == "") {
+		return a.log
+	}
+
+	if a.file != nil {
+		a.file.Close()
+		a.file = nil
+	}
+	a.path, a.log = path, nil
+
+	switch path {
+	case "":
+	case "stdout":
+		a.log = utils.NewLoggerAuditLog(klog.Background())
+	default:
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			// retried on the next call
+			klog.ErrorS(err, "Cannot open audit log, changes are not being audited", "path", path)
+			a.path = ""
+			return nil
+		}
+		a.file, a.log = f, utils.NewJsonAuditLog(f)
+	}
+	return a.log
+}
+
+func secretIdentity(namespace, name string) string {
+	return fmt.Sprintf("secret:%v/%v", namespace, name)
+}
+
+// credentialIdentity says which credentials a provider uses for a challenge,
+// for the audit log: the secret reference for secrets, and "ambient" for the
+// webhook's own credentials (environment or files)
+func credentialIdentity(provider CredentialProvider, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) string {
+	switch provider.(type) {
+	case *secretCredentialProvider:
+		ref, namespace := credentialSecret(cfg, ch)
+		return secretIdentity(namespace, ref.Name)
+	case *execCredentialProvider:
+		return "exec:" + cfg.Exec.Plugin
+	}
+	return "ambient"
+}
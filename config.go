@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+// webhookConfig holds the webhook-wide settings and defaults, read from the
+// YAML file pointed to by HE_CONFIG_FILE (usually mounted from a ConfigMap).
+// Values set in an Issuer's solver config take precedence over these.
+type webhookConfig struct {
+	// API group the webhook serves; cannot be changed by reloading
+	GroupName string `json:"groupName"`
+	// default credential provider: "env", "secret", "file" or "exec"
+	CredentialProvider string `json:"credentialProvider"`
+	// namespaces whose Issuers may choose each of the "env", "file" and
+	// "exec" credential providers when it's not the default one; "*" allows
+	// all of them
+	CredentialProviderNamespaces map[string][]string `json:"credentialProviderNamespaces"`
+	// default method: "login", "dynamic-dns" or "auto"
+	Method string `json:"method"`
+	// default HE URLs for each method
+	LoginUrl      string `json:"loginUrl"`
+	DynamicDnsUrl string `json:"dynamicDnsUrl"`
+	// default name of the credentials secret
+	SecretName string `json:"secretName"`
+	// TTL of the TXT records created in login mode
+	TTL int `json:"ttl"`
+	// timeout of each HTTP request to HE
+	Timeout metav1.Duration `json:"timeout"`
+	// HE nameservers, asked for the current value of a dynamic-dns record
+	// before resetting it in CleanUp
+	Nameservers []string `json:"nameservers"`
+	// value dynamic-dns records are reset to in CleanUp
+	DynamicDnsPlaceholder string `json:"dynamicDnsPlaceholder"`
+	// by default, wait in Present until all the nameservers serve the record
+	WaitForPropagation bool `json:"waitForPropagation"`
+	// how long to wait for propagation
+	PropagationTimeout metav1.Duration `json:"propagationTimeout"`
+	// what to do when a zone is not delegated to HE: "off", "warn" or "fail"
+	DelegationCheck string `json:"delegationCheck"`
+	// how long the result of a delegation check is reused
+	DelegationCheckTTL metav1.Duration `json:"delegationCheckTTL"`
+	// recursive resolvers used for the delegation check (host or host:port);
+	// if empty, the ones in /etc/resolv.conf
+	Resolvers []string `json:"resolvers"`
+	// how long a dynamic-dns record stays reserved for a challenge whose
+	// CleanUp doesn't come
+	DynamicDnsLockTimeout metav1.Duration `json:"dynamicDnsLockTimeout"`
+	// if not empty, the only URLs an Issuer may use as heUrl
+	AllowedEndpoints []string `json:"allowedEndpoints"`
+	// scheduled rotation of dynamic-dns keys
+	KeyRotation keyRotationConfig `json:"keyRotation"`
+	// where to record the changes made to DNS records: a file (JSON lines),
+	// "stdout" for the webhook's log, or empty to disable
+	AuditLog string `json:"auditLog"`
+	// how many snapshots of unexpected HE pages are kept, served on the
+	// metrics server at /debug/snapshots; 0 disables them
+	DebugSnapshots int `json:"debugSnapshots"`
+}
+
+// the most snapshots of HE pages kept in memory (up to 1MiB each)
+const maxDebugSnapshots = 50
+
+// the longest wait for propagation: Present must return before the API
+// server gives up on the request, after 60s, leaving time to set the record
+const maxPropagationTimeout = 45 * time.Second
+
+// defaultWebhookConfig returns the built-in defaults, taking into account the
+// legacy environment variables
+func defaultWebhookConfig() *webhookConfig {
+	cfg := &webhookConfig{
+		GroupName:     os.Getenv("GROUP_NAME"),
+		Method:        "login",
+		LoginUrl:      "https://dns.he.net/",
+		DynamicDnsUrl: "https://dyn.dns.he.net/",
+		SecretName:    "he-credentials",
+		TTL:           7200,
+		Timeout:       metav1.Duration{Duration: 60 * time.Second},
+
+		Nameservers:           utils.DefaultNameservers,
+		DynamicDnsPlaceholder: "UNUSED",
+		PropagationTimeout:    metav1.Duration{Duration: 30 * time.Second},
+		DelegationCheck:       "warn",
+		DelegationCheckTTL:    metav1.Duration{Duration: time.Hour},
+		DynamicDnsLockTimeout: metav1.Duration{Duration: 10 * time.Minute},
+	}
+	if os.Getenv("USE_SECRETS") == "true" {
+		cfg.CredentialProvider = "secret"
+	}
+	return cfg
+}
+
+// validate checks the config, returning all the problems found
+func (cfg *webhookConfig) validate() error {
+	var errs []error
+
+	if cfg.GroupName == "" {
+		errs = append(errs, fmt.Errorf("groupName must be specified (in the config file or with GROUP_NAME)"))
+	}
+	switch cfg.CredentialProvider {
+	case "", "env", "secret", "file", "exec":
+	default:
+		errs = append(errs, fmt.Errorf("invalid credentialProvider '%v', valid values are 'env', 'secret', 'file' or 'exec'", cfg.CredentialProvider))
+	}
+	for provider := range cfg.CredentialProviderNamespaces {
+		switch provider {
+		case "env", "file", "exec":
+		default:
+			errs = append(errs, fmt.Errorf("invalid credentialProviderNamespaces entry '%v', valid providers are 'env', 'file' or 'exec'", provider))
+		}
+	}
+	if cfg.Method == "" || !validMethod(cfg.Method) {
+		errs = append(errs, fmt.Errorf("invalid method '%v', valid values are 'login', 'dynamic-dns' or 'auto'", cfg.Method))
+	}
+	for name, u := range map[string]string{"loginUrl": cfg.LoginUrl, "dynamicDnsUrl": cfg.DynamicDnsUrl} {
+		if err := validateUrl(u); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %v: %v", name, err))
+		}
+	}
+	for _, u := range cfg.AllowedEndpoints {
+		if err := validateUrl(u); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allowedEndpoints entry: %v", err))
+		}
+	}
+	if cfg.SecretName == "" {
+		errs = append(errs, fmt.Errorf("secretName cannot be empty"))
+	}
+	if cfg.TTL < 300 || cfg.TTL > 86400 {
+		errs = append(errs, fmt.Errorf("ttl must be between 300 and 86400 seconds, got %v", cfg.TTL))
+	}
+	if cfg.Timeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("timeout must be positive, got %v", cfg.Timeout.Duration))
+	}
+	if cfg.DynamicDnsPlaceholder == "" {
+		errs = append(errs, fmt.Errorf("dynamicDnsPlaceholder cannot be empty"))
+	}
+	for _, ns := range cfg.Nameservers {
+		if ns == "" {
+			errs = append(errs, fmt.Errorf("invalid empty nameservers entry"))
+		}
+	}
+	if cfg.PropagationTimeout.Duration <= 0 || cfg.PropagationTimeout.Duration > maxPropagationTimeout {
+		errs = append(errs, fmt.Errorf("propagationTimeout must be positive and at most %v, got %v", maxPropagationTimeout, cfg.PropagationTimeout.Duration))
+	}
+	switch cfg.DelegationCheck {
+	case "off", "warn", "fail":
+	default:
+		errs = append(errs, fmt.Errorf("invalid delegationCheck '%v', valid values are 'off', 'warn' or 'fail'", cfg.DelegationCheck))
+	}
+	if cfg.DelegationCheckTTL.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("delegationCheckTTL must be positive, got %v", cfg.DelegationCheckTTL.Duration))
+	}
+	if cfg.DynamicDnsLockTimeout.Duration <= 0 {
+		errs = append(errs, fmt.Errorf("dynamicDnsLockTimeout must be positive, got %v", cfg.DynamicDnsLockTimeout.Duration))
+	}
+	if cfg.DebugSnapshots < 0 || cfg.DebugSnapshots > maxDebugSnapshots {
+		errs = append(errs, fmt.Errorf("debugSnapshots must be between 0 and %v, got %v", maxDebugSnapshots, cfg.DebugSnapshots))
+	}
+	errs = append(errs, cfg.KeyRotation.validate()...)
+
+	return errors.Join(errs...)
+}
+
+func validateUrl(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("'%v' is not an absolute http(s) URL", u)
+	}
+	return nil
+}
+
+// endpointAllowed tells whether heUrl is one of the allowed endpoints
+func (cfg *webhookConfig) endpointAllowed(heUrl string) bool {
+	if len(cfg.AllowedEndpoints) == 0 {
+		return true
+	}
+	for _, e := range cfg.AllowedEndpoints {
+		if withTrailingSlash(e) == withTrailingSlash(heUrl) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCredentialProvider returns an error if the Issuers in namespace may not
+// choose the given credential provider. The "secret" provider is subject to
+// the secret policy instead, and the default one is what the deployment uses
+// anyway, but the other ones give access to the webhook's own credentials or
+// plugins, and must be allowed explicitly.
+func (cfg *webhookConfig) checkCredentialProvider(provider string, namespace string) error {
+	if provider == "" || provider == "secret" || provider == cfg.CredentialProvider {
+		return nil
+	}
+	for _, ns := range cfg.CredentialProviderNamespaces[provider] {
+		if ns == "*" || ns == namespace {
+			return nil
+		}
+	}
+	return fmt.Errorf("the %v credential provider is not allowed for issuers in namespace %v, see credentialProviderNamespaces in the webhook config", provider, namespace)
+}
+
+func withTrailingSlash(u string) string {
+	if !strings.HasSuffix(u, "/") {
+		return u + "/"
+	}
+	return u
+}
+
+// loadWebhookConfig reads the config file (if any) on top of the defaults
+func loadWebhookConfig(path string) (*webhookConfig, error) {
+	cfg := defaultWebhookConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("cannot parse config file %v: %v", path, err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, nil
+}
+
+// configStore holds the current webhook config, reloading it when the file
+// changes. A nil store serves the defaults.
+type configStore struct {
+	path    string
+	current atomic.Pointer[webhookConfig]
+}
+
+func newConfigStore(path string) (*configStore, error) {
+	cfg, err := loadWebhookConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &configStore{path: path}
+	s.current.Store(cfg)
+	return s, nil
+}
+
+// Get returns the current config, which must not be modified
+func (s *configStore) Get() *webhookConfig {
+	if s == nil {
+		return defaultWebhookConfig()
+	}
+	return s.current.Load()
+}
+
+// Watch reloads the config file when it changes, until stopCh is closed. An
+// invalid new config is logged and ignored, keeping the previous one.
+func (s *configStore) Watch(stopCh <-chan struct{}) error {
+	if s == nil || s.path == "" {
+		return nil
+	}
+	return watchFiles([]string{s.path}, stopCh, func() {
+		cfg, err := loadWebhookConfig(s.path)
+		if err != nil {
+			klog.ErrorS(err, "Not reloading config file", "path", s.path)
+			return
+		}
+		if cfg.GroupName != s.Get().GroupName {
+			klog.InfoS("Changing groupName requires a restart, keeping the old one", "groupName", s.Get().GroupName)
+			cfg.GroupName = s.Get().GroupName
+		}
+		if reflect.DeepEqual(cfg, s.Get()) {
+			return
+		}
+		s.current.Store(cfg)
+		klog.InfoS("Reloaded config file", "path", s.path)
+	})
+}
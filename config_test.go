@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, path string, contents string) {
+	t.Helper()
+	// replaced atomically, so the watcher never reads a partial file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadWebhookConfig(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	dir := t.TempDir()
+
+	cfg, err := loadWebhookConfig("")
+	if err != nil {
+		t.Fatalf("the defaults are invalid: %v", err)
+	}
+	if cfg.GroupName != "acme.example.com" || cfg.Method != "login" || cfg.TTL != 7200 {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+
+	path := filepath.Join(dir, "config.yaml")
+	writeConfigFile(t, path, "method: dynamic-dns\nttl: 300\ntimeout: 30s\n")
+	cfg, err = loadWebhookConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Method != "dynamic-dns" || cfg.TTL != 300 || cfg.Timeout.Duration != 30*time.Second || cfg.LoginUrl != "https://dns.he.net/" {
+		t.Errorf("file not applied over the defaults: %+v", cfg)
+	}
+
+	writeConfigFile(t, path, "metod: login\n")
+	if _, err := loadWebhookConfig(path); err == nil || !strings.Contains(err.Error(), "metod") {
+		t.Errorf("got %v, want an unknown field error", err)
+	}
+
+	if _, err := loadWebhookConfig(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("no error for a missing file")
+	}
+}
+
+func TestWebhookConfigValidate(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+
+	tests := []struct {
+		name    string
+		modify  func(*webhookConfig)
+		wantErr []string
+	}{
+		{name: "defaults", modify: func(*webhookConfig) {}},
+		{name: "group name", modify: func(c *webhookConfig) { c.GroupName = "" }, wantErr: []string{"groupName"}},
+		{name: "provider", modify: func(c *webhookConfig) { c.CredentialProvider = "vault" }, wantErr: []string{"credentialProvider 'vault'"}},
+		{
+			name:    "provider namespaces",
+			modify:  func(c *webhookConfig) { c.CredentialProviderNamespaces = map[string][]string{"secret": {"*"}} },
+			wantErr: []string{"credentialProviderNamespaces entry 'secret'"},
+		},
+		{name: "method", modify: func(c *webhookConfig) { c.Method = "" }, wantErr: []string{"invalid method"}},
+		{name: "url", modify: func(c *webhookConfig) { c.LoginUrl = "dns.he.net" }, wantErr: []string{"invalid loginUrl"}},
+		{name: "endpoints", modify: func(c *webhookConfig) { c.AllowedEndpoints = []string{"ftp://he.net"} }, wantErr: []string{"allowedEndpoints"}},
+		{name: "ttl", modify: func(c *webhookConfig) { c.TTL = 60 }, wantErr: []string{"ttl"}},
+		{name: "delegation", modify: func(c *webhookConfig) { c.DelegationCheck = "maybe" }, wantErr: []string{"delegationCheck"}},
+		{name: "propagation timeout", modify: func(c *webhookConfig) { c.PropagationTimeout.Duration = time.Minute }, wantErr: []string{"propagationTimeout must be positive and at most 45s"}},
+		{name: "snapshots", modify: func(c *webhookConfig) { c.DebugSnapshots = maxDebugSnapshots + 1 }, wantErr: []string{"debugSnapshots"}},
+		{
+			name: "all problems together",
+			modify: func(c *webhookConfig) {
+				c.TTL = 0
+				c.SecretName = ""
+				c.DynamicDnsPlaceholder = ""
+			},
+			wantErr: []string{"ttl", "secretName", "dynamicDnsPlaceholder"},
+		},
+	}
+	for _, tt := range tests {
+		cfg := defaultWebhookConfig()
+		tt.modify(cfg)
+		err := cfg.validate()
+		if len(tt.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: no error", tt.name)
+			continue
+		}
+		for _, want := range tt.wantErr {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%v: got %v, want it to mention %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestConfigStoreReload(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfigFile(t, path, "ttl: 300\n")
+
+	s, err := newConfigStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := s.Watch(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor := func(what string, cond func(*webhookConfig) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond(s.Get()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v: config is %+v", what, s.Get())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// groupName cannot be changed without a restart
+	writeConfigFile(t, path, "ttl: 600\ngroupName: other.example.com\n")
+	waitFor("not reloaded", func(c *webhookConfig) bool { return c.TTL == 600 })
+	if got := s.Get().GroupName; got != "acme.example.com" {
+		t.Errorf("groupName changed to %v by a reload", got)
+	}
+
+	// an invalid file is ignored, and the next valid one loaded
+	writeConfigFile(t, path, "ttl: 1\n")
+	writeConfigFile(t, path, "ttl: 900\n")
+	waitFor("not reloaded after an invalid file", func(c *webhookConfig) bool { return c.TTL == 900 })
+
+	writeConfigFile(t, path, "ttl: 1\n")
+	time.Sleep(200 * time.Millisecond)
+	if got := s.Get().TTL; got != 900 {
+		t.Errorf("invalid config loaded: ttl %v", got)
+	}
+}
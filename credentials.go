@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// how long an exec credential plugin may run
+const execPluginTimeout = 30 * time.Second
+
+// credentials holds whatever a CredentialProvider could find; which fields are
+// needed depends on the method.
+type credentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	TotpSecret string `json:"totpSecret"`
+	ApiKey     string `json:"apiKey"`
+}
+
+// A CredentialProvider supplies the HE credentials needed to solve a
+// challenge with the given (already defaulted) configuration.
+type CredentialProvider interface {
+	Credentials(ctx context.Context, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (*credentials, error)
+}
+
+// execConfig selects the plugin run by the "exec" credential provider
+type execConfig struct {
+	// name of an executable in HE_CREDENTIAL_PLUGIN_DIR
+	Plugin string `json:"plugin"`
+	// optional extra arguments
+	Args []string `json:"args"`
+}
+
+// credentialProvider returns the provider selected by the (already defaulted)
+// config. If none was chosen, either in the issuer or in the webhook config,
+// files are used if configured, and the environment otherwise.
+func (c *heProviderSolver) credentialProvider(cfg heProviderConfig) (CredentialProvider, error) {
+
+	name := cfg.CredentialProvider
+	if name == "" {
+		if c.files != nil {
+			name = "file"
+		} else {
+			name = "env"
+		}
+	}
+
+	switch name {
+	case "env":
+		return &envCredentialProvider{}, nil
+	case "secret":
+		if c.secrets == nil {
+			return nil, fmt.Errorf("the secret credential provider is not available")
+		}
+		return &secretCredentialProvider{secrets: c.secrets}, nil
+	case "file":
+		if c.files == nil {
+			return nil, fmt.Errorf("the file credential provider needs HE_CREDENTIALS_DIR or HE_*_FILE to be set in the webhook deployment")
+		}
+		return &fileCredentialProvider{files: c.files}, nil
+	case "exec":
+		dir := os.Getenv("HE_CREDENTIAL_PLUGIN_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("the exec credential provider needs HE_CREDENTIAL_PLUGIN_DIR to be set in the webhook deployment")
+		}
+		return &execCredentialProvider{pluginDir: dir, timeout: execPluginTimeout}, nil
+	}
+	return nil, fmt.Errorf("invalid credential provider '%v', valid values are 'env', 'secret', 'file' or 'exec'", name)
+}
+
+// envCredentialProvider reads the credentials from the webhook's environment
+type envCredentialProvider struct{}
+
+func (p *envCredentialProvider) Credentials(ctx context.Context, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (*credentials, error) {
+	creds := &credentials{}
+	if cfg.Method != "dynamic-dns" {
+		creds.Username = os.Getenv("HE_USERNAME")
+		creds.Password = os.Getenv("HE_PASSWORD")
+		creds.TotpSecret = os.Getenv("HE_TOTP_SECRET")
+	}
+	if cfg.Method != "login" {
+		creds.ApiKey = os.Getenv("HE_APIKEY")
+	}
+	return creds, nil
+}
+
+// fileCredentialProvider reads the credentials from (watched) files
+type fileCredentialProvider struct {
+	files *fileCredentials
+}
+
+func (p *fileCredentialProvider) Credentials(ctx context.Context, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (*credentials, error) {
+	creds := &credentials{}
+	if cfg.Method != "dynamic-dns" {
+		creds.Username = p.files.Get("username")
+		creds.Password = p.files.Get("password")
+		creds.TotpSecret = p.files.Get("totpSecret")
+	}
+	if cfg.Method != "login" {
+		creds.ApiKey = p.files.Get("apiKey")
+	}
+	return creds, nil
+}
+
+// secretCredentialProvider reads the credentials from the kubernetes secrets
+// referenced in the config
+type secretCredentialProvider struct {
+	secrets *secretCache
+}
+
+// credentialSecret returns the secret reference used for the method, and
+// the namespace it's looked for in
+func credentialSecret(cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (secretRef, string) {
+
+	// with the auto method, resolveConfig has put the only reference given in
+	// CredentialsSecretRef
+	ref := cfg.ApiKeySecretRef
+	if cfg.Method != "dynamic-dns" {
+		ref = cfg.CredentialsSecretRef
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = ch.ResourceNamespace
+	}
+	return ref, namespace
+}
+
+func (p *secretCredentialProvider) Credentials(ctx context.Context, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (*credentials, error) {
+
+	ref, namespace := credentialSecret(cfg, ch)
+
+	sec, err := p.secrets.Get(namespace, ref.Name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret `%s/%s`: %v", namespace, ref.Name, err)
+	}
+	secretData := &sec.Data
+
+	creds := &credentials{}
+
+	usernameKey := keyOrDefault(ref.UsernameKey, "username")
+	passwordKey := keyOrDefault(ref.PasswordKey, "password")
+	totpSecretKey := keyOrDefault(ref.TotpSecretKey, "totpSecret")
+	apiKeyKey := keyOrDefault(ref.ApiKeyKey, "apiKey")
+
+	// get a key that may legitimately be missing
+	optionalKey := func(key string) (string, error) {
+		if _, ok := (*secretData)[key]; !ok {
+			return "", nil
+		}
+		value, err := getKeyFromSecret(secretData, key)
+		if err != nil {
+			return "", fmt.Errorf("unable to get %v from secret `%s/%s`; %v", key, namespace, ref.Name, err)
+		}
+		return value, nil
+	}
+
+	switch cfg.Method {
+	case "login":
+		username, err := getKeyFromSecret(secretData, usernameKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %v from secret `%s/%s`; %v", usernameKey, namespace, ref.Name, err)
+		}
+		creds.Username = username
+
+		password, err := getKeyFromSecret(secretData, passwordKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %v from secret `%s/%s`; %v", passwordKey, namespace, ref.Name, err)
+		}
+		creds.Password = password
+
+		// the TOTP secret is only needed for accounts with two-factor authentication
+		if creds.TotpSecret, err = optionalKey(totpSecretKey); err != nil {
+			return nil, err
+		}
+
+	case "dynamic-dns":
+		apiKey, err := getKeyFromSecret(secretData, apiKeyKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %v from secret `%s/%s`; %v", apiKeyKey, namespace, ref.Name, err)
+		}
+		creds.ApiKey = apiKey
+
+	default:
+		// auto: take whatever is there (missing or empty keys are fine),
+		// the method is chosen from that
+		for key, value := range map[string]*string{
+			usernameKey:   &creds.Username,
+			passwordKey:   &creds.Password,
+			totpSecretKey: &creds.TotpSecret,
+			apiKeyKey:     &creds.ApiKey,
+		} {
+			*value, _ = getKeyFromSecret(secretData, key)
+		}
+	}
+	return creds, nil
+}
+
+// execCredentialProvider runs an external plugin, which gets a JSON
+// description of the challenge on stdin and must write the credentials as a
+// JSON object (with the same fields as the `credentials` struct) to stdout.
+// Only executables in pluginDir can be run, so that an Issuer cannot make the
+// webhook run arbitrary commands.
+type execCredentialProvider struct {
+	pluginDir string
+	// how long the plugin may run
+	timeout time.Duration
+}
+
+// what the plugin gets on stdin
+type execPluginRequest struct {
+	Method    string `json:"method"`
+	Zone      string `json:"zone"`
+	FQDN      string `json:"fqdn"`
+	Namespace string `json:"namespace"`
+	HeUrl     string `json:"heUrl"`
+	// the identifier of the challenge in the webhook's log lines
+	Challenge string `json:"challenge"`
+}
+
+func (p *execCredentialProvider) Credentials(ctx context.Context, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (*credentials, error) {
+
+	plugin := cfg.Exec.Plugin
+	if plugin == "" || plugin != filepath.Base(plugin) || strings.HasPrefix(plugin, ".") {
+		return nil, fmt.Errorf("invalid exec plugin name '%v', it must be the name of an executable in %v", plugin, p.pluginDir)
+	}
+	path := filepath.Join(p.pluginDir, plugin)
+
+	request, err := json.Marshal(execPluginRequest{
+		Method:    cfg.Method,
+		Zone:      strings.TrimSuffix(ch.ResolvedZone, "."),
+		FQDN:      strings.TrimSuffix(ch.ResolvedFQDN, "."),
+		Namespace: ch.ResourceNamespace,
+		HeUrl:     cfg.HeUrl,
+		Challenge: challengeTag(ch),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, cfg.Exec.Args...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	klog.FromContext(ctx).V(4).Info("Running credential plugin", "plugin", path, "args", cfg.Exec.Args)
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential plugin %v failed: %v: %v", plugin, err, strings.TrimSpace(stderr.String()))
+	}
+
+	creds := &credentials{}
+	if err := json.Unmarshal(stdout.Bytes(), creds); err != nil {
+		return nil, fmt.Errorf("cannot decode output of credential plugin %v: %v", plugin, err)
+	}
+	return creds, nil
+}
+
+// chooseMethod picks the method for the "auto" mode, based on the
+// credentials that are available
+func chooseMethod(creds *credentials) (string, error) {
+	if creds.Username != "" && creds.Password != "" {
+		return "login", nil
+	}
+	if creds.ApiKey != "" {
+		return "dynamic-dns", nil
+	}
+	return "", fmt.Errorf("cannot choose a method automatically: found neither a username and password nor an apiKey")
+}
+
+// extract a key from a secret
+func getKeyFromSecret(secretData *map[string][]byte, key string) (string, error) {
+
+	data, ok := (*secretData)[key]
+
+	if !ok {
+		return "", fmt.Errorf("key %q not found in secret data", key)
+	}
+	d := string(data)
+	if d == "" {
+		return "", fmt.Errorf("value for key %q is empty", key)
+	}
+	return d, nil
+}
+
+// return the configured key name, or the default one if not set
+func keyOrDefault(key string, def string) string {
+	if key == "" {
+		return def
+	}
+	return key
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testChallengeRequest() *v1alpha1.ChallengeRequest {
+	return &v1alpha1.ChallengeRequest{
+		ResourceNamespace: "certs",
+		ResolvedZone:      "example.com.",
+		ResolvedFQDN:      "_acme-challenge.example.com.",
+		DNSName:           "example.com",
+		Key:               "challenge-key",
+	}
+}
+
+func TestEnvCredentialProvider(t *testing.T) {
+	t.Setenv("HE_USERNAME", "user")
+	t.Setenv("HE_PASSWORD", "pass")
+	t.Setenv("HE_TOTP_SECRET", "totp")
+	t.Setenv("HE_APIKEY", "key")
+
+	tests := []struct {
+		method string
+		want   credentials
+	}{
+		{"login", credentials{Username: "user", Password: "pass", TotpSecret: "totp"}},
+		{"dynamic-dns", credentials{ApiKey: "key"}},
+		{"auto", credentials{Username: "user", Password: "pass", TotpSecret: "totp", ApiKey: "key"}},
+	}
+	for _, tt := range tests {
+		got, err := (&envCredentialProvider{}).Credentials(context.Background(), heProviderConfig{Method: tt.method}, testChallengeRequest())
+		if err != nil {
+			t.Errorf("%v: %v", tt.method, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.method, *got, tt.want)
+		}
+	}
+}
+
+func TestFileCredentialProvider(t *testing.T) {
+	files := &fileCredentials{values: map[string]string{"username": "user", "password": "pass", "apiKey": "key"}}
+
+	tests := []struct {
+		method string
+		want   credentials
+	}{
+		{"login", credentials{Username: "user", Password: "pass"}},
+		{"dynamic-dns", credentials{ApiKey: "key"}},
+		{"auto", credentials{Username: "user", Password: "pass", ApiKey: "key"}},
+	}
+	for _, tt := range tests {
+		got, err := (&fileCredentialProvider{files: files}).Credentials(context.Background(), heProviderConfig{Method: tt.method}, testChallengeRequest())
+		if err != nil {
+			t.Errorf("%v: %v", tt.method, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.method, *got, tt.want)
+		}
+	}
+}
+
+func TestSecretCredentialProvider(t *testing.T) {
+	secret := func(namespace, name string, data map[string]string) *corev1.Secret {
+		s := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}, Data: map[string][]byte{}}
+		for k, v := range data {
+			s.Data[k] = []byte(v)
+		}
+		return s
+	}
+	client := fake.NewSimpleClientset(
+		secret("certs", "he-credentials", map[string]string{"username": "user", "password": "pass", "apiKey": "key"}),
+		secret("certs", "custom", map[string]string{"user": "user2", "pass": "pass2", "otp": "totp2", "ddns": "key2"}),
+		secret("certs", "no-password", map[string]string{"username": "user"}),
+		secret("shared", "he-credentials", map[string]string{"username": "shared-user", "password": "shared-pass"}),
+	)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	provider := &secretCredentialProvider{secrets: newSecretCache(client, stopCh)}
+
+	tests := []struct {
+		name    string
+		cfg     heProviderConfig
+		want    credentials
+		wantErr string
+	}{
+		{
+			name: "login",
+			cfg:  heProviderConfig{Method: "login", CredentialsSecretRef: secretRef{Name: "he-credentials"}},
+			want: credentials{Username: "user", Password: "pass"},
+		},
+		{
+			name: "login with custom keys and totp",
+			cfg: heProviderConfig{Method: "login", CredentialsSecretRef: secretRef{
+				Name: "custom", UsernameKey: "user", PasswordKey: "pass", TotpSecretKey: "otp",
+			}},
+			want: credentials{Username: "user2", Password: "pass2", TotpSecret: "totp2"},
+		},
+		{
+			name: "login in another namespace",
+			cfg:  heProviderConfig{Method: "login", CredentialsSecretRef: secretRef{Name: "he-credentials", Namespace: "shared"}},
+			want: credentials{Username: "shared-user", Password: "shared-pass"},
+		},
+		{
+			name:    "login without password",
+			cfg:     heProviderConfig{Method: "login", CredentialsSecretRef: secretRef{Name: "no-password"}},
+			wantErr: `key "password" not found`,
+		},
+		{
+			name: "dynamic-dns",
+			cfg:  heProviderConfig{Method: "dynamic-dns", ApiKeySecretRef: secretRef{Name: "custom", ApiKeyKey: "ddns"}},
+			want: credentials{ApiKey: "key2"},
+		},
+		{
+			name: "auto takes what is there",
+			cfg:  heProviderConfig{Method: "auto", CredentialsSecretRef: secretRef{Name: "no-password"}},
+			want: credentials{Username: "user"},
+		},
+		{
+			name:    "missing secret",
+			cfg:     heProviderConfig{Method: "login", CredentialsSecretRef: secretRef{Name: "missing"}},
+			wantErr: "unable to read secret `certs/missing`",
+		},
+	}
+	for _, tt := range tests {
+		got, err := provider.Credentials(context.Background(), tt.cfg, testChallengeRequest())
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func TestExecCredentialProvider(t *testing.T) {
+	dir := t.TempDir()
+	plugins := map[string]string{
+		// answers with the zone it was asked for, to check the request
+		"zone-user": `read -r request; zone=$(echo "$request" | sed 's/.*"zone":"\([^"]*\)".*/\1/'); echo "{\"username\":\"$zone\",\"password\":\"$1\"}"`,
+		"fails":     `echo "no credentials for you" >&2; exit 3`,
+		"garbage":   `echo "not json"`,
+		"slow":      `exec sleep 10`,
+	}
+	for name, script := range plugins {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider := &execCredentialProvider{pluginDir: dir, timeout: 500 * time.Millisecond}
+
+	tests := []struct {
+		plugin  string
+		args    []string
+		want    credentials
+		wantErr string
+	}{
+		{plugin: "zone-user", args: []string{"secret"}, want: credentials{Username: "example.com", Password: "secret"}},
+		{plugin: "fails", wantErr: "no credentials for you"},
+		{plugin: "garbage", wantErr: "cannot decode output"},
+		{plugin: "slow", wantErr: "killed"},
+		{plugin: "", wantErr: "invalid exec plugin name"},
+		{plugin: "../zone-user", wantErr: "invalid exec plugin name"},
+		{plugin: "sub/zone-user", wantErr: "invalid exec plugin name"},
+		{plugin: "/bin/sh", wantErr: "invalid exec plugin name"},
+		{plugin: ".hidden", wantErr: "invalid exec plugin name"},
+		{plugin: "missing", wantErr: "failed"},
+	}
+	for _, tt := range tests {
+		cfg := heProviderConfig{Method: "login", Exec: execConfig{Plugin: tt.plugin, Args: tt.args}}
+		start := time.Now()
+		got, err := provider.Credentials(context.Background(), cfg, testChallengeRequest())
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%v: the plugin ran for %v, past its timeout", tt.plugin, elapsed)
+		}
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: got error %v, want %q", tt.plugin, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.plugin, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("%v: got %+v, want %+v", tt.plugin, *got, tt.want)
+		}
+	}
+}
+
+func TestCredentialProviderSelection(t *testing.T) {
+	files := &fileCredentials{values: map[string]string{}}
+
+	tests := []struct {
+		name     string
+		provider string
+		files    *fileCredentials
+		// HE_CREDENTIAL_PLUGIN_DIR
+		pluginDir string
+		want      CredentialProvider
+		wantErr   string
+	}{
+		{name: "default without files", want: &envCredentialProvider{}},
+		{name: "default with files", files: files, want: &fileCredentialProvider{files: files}},
+		{name: "file without files", provider: "file", wantErr: "HE_CREDENTIALS_DIR"},
+		{name: "exec", provider: "exec", pluginDir: "/plugins", want: &execCredentialProvider{pluginDir: "/plugins", timeout: execPluginTimeout}},
+		{name: "exec without plugin dir", provider: "exec", wantErr: "HE_CREDENTIAL_PLUGIN_DIR"},
+		{name: "secret without cache", provider: "secret", wantErr: "not available"},
+		{name: "invalid", provider: "vault", wantErr: "invalid credential provider"},
+	}
+	for _, tt := range tests {
+		t.Setenv("HE_CREDENTIAL_PLUGIN_DIR", tt.pluginDir)
+		c := &heProviderSolver{files: tt.files}
+		got, err := c.credentialProvider(heProviderConfig{CredentialProvider: tt.provider})
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%v: got error %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCredentialProvider(t *testing.T) {
+	settings := &webhookConfig{
+		CredentialProvider: "secret",
+		CredentialProviderNamespaces: map[string][]string{
+			"exec": {"team-a", "cert-manager"},
+			"env":  {"*"},
+		},
+	}
+
+	tests := []struct {
+		provider  string
+		namespace string
+		allowed   bool
+	}{
+		{"", "anywhere", true},
+		{"secret", "anywhere", true},
+		{"env", "anywhere", true},
+		{"exec", "team-a", true},
+		{"exec", "cert-manager", true},
+		{"exec", "team-b", false},
+		{"file", "team-a", false},
+	}
+	for _, tt := range tests {
+		err := settings.checkCredentialProvider(tt.provider, tt.namespace)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%v in %v: got %v, want allowed=%v", tt.provider, tt.namespace, err, tt.allowed)
+		}
+	}
+
+	// the default provider needs no entry
+	settings.CredentialProvider = "file"
+	if err := settings.checkCredentialProvider("file", "team-b"); err != nil {
+		t.Errorf("the default provider was rejected: %v", err)
+	}
+}
+
+func TestChooseMethod(t *testing.T) {
+	tests := []struct {
+		creds credentials
+		want  string
+	}{
+		{credentials{Username: "user", Password: "pass"}, "login"},
+		{credentials{Username: "user", Password: "pass", ApiKey: "key"}, "login"},
+		{credentials{Username: "user", ApiKey: "key"}, "dynamic-dns"},
+		{credentials{ApiKey: "key"}, "dynamic-dns"},
+		{credentials{Username: "user"}, ""},
+		{credentials{}, ""},
+	}
+	for _, tt := range tests {
+		got, err := chooseMethod(&tt.creds)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%+v: got %v, want an error", tt.creds, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%+v: got %v (%v), want %v", tt.creds, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// fileCredentials holds credentials read from files, eg a mounted Secret, a
+// projected volume or a CSI secret-store volume, and reloads them whenever
+// the files change, so rotated values are used without restarting the webhook.
+type fileCredentials struct {
+	// credential name ("username", "password", ...) -> file path
+	paths map[string]string
+
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// the credentials we know about, with the env var that can point to each file
+var credentialFileVars = map[string]string{
+	"username":   "HE_USERNAME_FILE",
+	"password":   "HE_PASSWORD_FILE",
+	"totpSecret": "HE_TOTP_SECRET_FILE",
+	"apiKey":     "HE_APIKEY_FILE",
+}
+
+// newFileCredentialsFromEnv returns the file credentials configured with
+// HE_CREDENTIALS_DIR (which is expected to contain files named after the
+// credentials, ie `username`, `password`, `totpSecret` and `apiKey`) and/or
+// the HE_*_FILE variables, which take precedence. It returns nil if none
+// of them is set.
+func newFileCredentialsFromEnv() *fileCredentials {
+
+	paths := map[string]string{}
+
+	if dir := os.Getenv("HE_CREDENTIALS_DIR"); dir != "" {
+		for name := range credentialFileVars {
+			paths[name] = filepath.Join(dir, name)
+		}
+	}
+	for name, envVar := range credentialFileVars {
+		if path := os.Getenv(envVar); path != "" {
+			paths[name] = path
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	fc := &fileCredentials{
+		paths:  paths,
+		values: map[string]string{},
+	}
+	fc.reload()
+	return fc
+}
+
+// Get returns the current value of a credential, or "" if it's not available
+func (fc *fileCredentials) Get(name string) string {
+	fc.mu.RLock()
+	defer fc.mu.RUnlock()
+	return fc.values[name]
+}
+
+func (fc *fileCredentials) reload() {
+
+	values := map[string]string{}
+	for name, path := range fc.paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			// not all credentials are needed by every method
+			if !os.IsNotExist(err) {
+				klog.ErrorS(err, "Cannot read credentials file", "path", path)
+			}
+			continue
+		}
+		values[name] = strings.TrimRight(string(data), "\r\n")
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for name, value := range values {
+		if fc.values[name] != value {
+			klog.InfoS("Loaded credential from file", "credential", name, "path", fc.paths[name])
+		}
+	}
+	fc.values = values
+}
+
+// Watch reloads the credentials whenever the files change, until stopCh is
+// closed.
+func (fc *fileCredentials) Watch(stopCh <-chan struct{}) error {
+	paths := []string{}
+	for _, path := range fc.paths {
+		paths = append(paths, path)
+	}
+	return watchFiles(paths, stopCh, fc.reload)
+}
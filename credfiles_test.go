@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeAtomicDir lays out dir the way the kubelet updates a mounted volume:
+// the files are written to a new timestamped directory, and the `..data`
+// symlink is then atomically swapped to point to it
+func writeAtomicDir(t *testing.T, dir string, version string, files map[string]string) {
+	t.Helper()
+
+	versionDir := filepath.Join(dir, "..v"+version)
+	if err := os.Mkdir(versionDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range files {
+		if err := os.WriteFile(filepath.Join(versionDir, name), []byte(value), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, name)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(filepath.Join("..data", name), link); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(versionDir), tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileCredentialsFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "username"), []byte("user\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "password"), []byte("pass\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	apiKeyFile := filepath.Join(t.TempDir(), "ddns-key")
+	if err := os.WriteFile(apiKeyFile, []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HE_CREDENTIALS_DIR", dir)
+	t.Setenv("HE_APIKEY_FILE", apiKeyFile)
+	fc := newFileCredentialsFromEnv()
+	if fc == nil {
+		t.Fatal("no file credentials with HE_CREDENTIALS_DIR set")
+	}
+
+	for name, want := range map[string]string{
+		"username":   "user",
+		"password":   "pass",
+		"totpSecret": "",
+		"apiKey":     "key",
+	} {
+		if got := fc.Get(name); got != want {
+			t.Errorf("%v: got %q, want %q", name, got, want)
+		}
+	}
+
+	t.Setenv("HE_CREDENTIALS_DIR", "")
+	t.Setenv("HE_APIKEY_FILE", "")
+	if fc := newFileCredentialsFromEnv(); fc != nil {
+		t.Errorf("got file credentials with no variable set")
+	}
+}
+
+func TestFileCredentialsReloadOnSymlinkSwap(t *testing.T) {
+	dir := t.TempDir()
+	writeAtomicDir(t, dir, "1", map[string]string{"apiKey": "key-1"})
+
+	t.Setenv("HE_CREDENTIALS_DIR", dir)
+	fc := newFileCredentialsFromEnv()
+	if got := fc.Get("apiKey"); got != "key-1" {
+		t.Fatalf("got apiKey %q, want key-1", got)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := fc.Watch(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	writeAtomicDir(t, dir, "2", map[string]string{"apiKey": "key-2"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for fc.Get("apiKey") != "key-2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("apiKey not reloaded after the symlink swap, still %q", fc.Get("apiKey"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+var (
+	errRecordInUse      = errors.New("dynamic-dns record in use")
+	errDynamicDnsPaused = errors.New("dynamic DNS updates paused")
+)
+
+// dynamicDnsLocks serializes the challenges using the same dynamic-dns
+// record, which can only hold one value: the record belongs to the first
+// challenge presented until its CleanUp runs (or the timeout passes), and
+// the other ones fail in Present meanwhile, so cert-manager retries them
+// later instead of overwriting the value in use.
+type dynamicDnsLocks struct {
+	mu      sync.Mutex
+	holders map[string]dynamicDnsHolder
+}
+
+type dynamicDnsHolder struct {
+	key   string
+	since time.Time
+}
+
+// acquire reserves the record for the challenge with the given key
+func (l *dynamicDnsLocks) acquire(ctx context.Context, hostname string, key string, timeout time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.holders == nil {
+		l.holders = map[string]dynamicDnsHolder{}
+	}
+	if h, ok := l.holders[hostname]; ok && h.key != key {
+		if time.Since(h.since) < timeout {
+			return fmt.Errorf("%w: %v is used by another challenge since %v, will retry", errRecordInUse, hostname, h.since.Format(time.RFC3339))
+		}
+		klog.FromContext(ctx).Info("Taking over dynamic-dns record from a challenge that was not cleaned up", "hostname", hostname, "since", h.since)
+	} else if ok {
+		// presented again, keep the original time
+		return nil
+	}
+	l.holders[hostname] = dynamicDnsHolder{key: key, since: time.Now()}
+	return nil
+}
+
+// release frees the record if it's held by the challenge with the given key.
+// It tells whether the record can be reset, ie it's not in use by another
+// challenge.
+func (l *dynamicDnsLocks) release(hostname string, key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h, ok := l.holders[hostname]
+	if !ok {
+		return true
+	}
+	if h.key != key {
+		return false
+	}
+	delete(l.holders, hostname)
+	return true
+}
+
+// how long to stop updating a record after HE asked to slow down
+const (
+	dynamicDnsAbuseCooldown    = 30 * time.Minute
+	dynamicDnsIntervalCooldown = 5 * time.Minute
+)
+
+// dynamicDnsCooldowns pauses the updates of the records for which HE answered
+// "abuse" or "interval", so that cert-manager's retries don't make it worse
+type dynamicDnsCooldowns struct {
+	mu        sync.Mutex
+	cooldowns map[string]dynamicDnsCooldown
+}
+
+type dynamicDnsCooldown struct {
+	until time.Time
+	// the credentials in use when HE asked to slow down, see credentialIdentity
+	credentials string
+}
+
+// check returns an error if updates of hostname are paused
+func (c *dynamicDnsCooldowns) check(hostname string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cd, ok := c.cooldowns[hostname]; ok {
+		if time.Now().Before(cd.until) {
+			return fmt.Errorf("%w: HE asked to slow down, updates of %v are paused until %v", errDynamicDnsPaused, hostname, cd.until.Format(time.RFC3339))
+		}
+		delete(c.cooldowns, hostname)
+	}
+	return nil
+}
+
+// update starts a cool-down if err says so
+func (c *dynamicDnsCooldowns) update(ctx context.Context, hostname string, credentials string, err error) {
+	de, ok := utils.IsThrottled(err)
+	if !ok {
+		return
+	}
+	d := dynamicDnsIntervalCooldown
+	if de.Code == utils.DynamicDnsAbuse {
+		d = dynamicDnsAbuseCooldown
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cooldowns == nil {
+		c.cooldowns = map[string]dynamicDnsCooldown{}
+	}
+	c.cooldowns[hostname] = dynamicDnsCooldown{until: time.Now().Add(d), credentials: credentials}
+	klog.FromContext(ctx).Info("Pausing dynamic DNS updates", "hostname", hostname, "reason", de.Code, "duration", d)
+}
+
+// clear ends the cool-downs started while using the given credentials, since
+// they have been changed (typically, to fix a wrong key)
+func (c *dynamicDnsCooldowns) clear(credentials string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for hostname, cd := range c.cooldowns {
+		if cd.credentials == credentials {
+			delete(c.cooldowns, hostname)
+			klog.InfoS("Resuming dynamic DNS updates, the credentials have changed", "hostname", hostname, "credentials", credentials)
+		}
+	}
+}
+
+func dynamicDnsHostname(ch *v1alpha1.ChallengeRequest) string {
+	return strings.ToLower(strings.TrimSuffix(ch.ResolvedFQDN, "."))
+}
+
+// presentDynamicDns sets the record through dynamic DNS, if it's not in use by
+// another challenge
+func (c *heProviderSolver) presentDynamicDns(ctx context.Context, hc *utils.HeClient, ch *v1alpha1.ChallengeRequest) error {
+	hostname := dynamicDnsHostname(ch)
+	if err := c.ddnsCooldowns.check(hostname); err != nil {
+		return err
+	}
+	if err := c.ddnsLocks.acquire(ctx, hostname, ch.Key, c.config.Get().DynamicDnsLockTimeout.Duration); err != nil {
+		return err
+	}
+	if err := hc.AddTxtRecordWithDynamicDns(ctx, ch); err != nil {
+		c.ddnsCooldowns.update(ctx, hostname, hc.AuditSubject.Credentials, err)
+		c.ddnsLocks.release(hostname, ch.Key)
+		return err
+	}
+	return nil
+}
+
+// cleanUpDynamicDns resets the record through dynamic DNS, unless another
+// challenge is using it now. The record is released even if the updates are
+// paused, so that the next challenge isn't blocked until the lock times out;
+// cert-manager retries the CleanUp, which then resets the record unless the
+// next challenge has taken it meanwhile.
+func (c *heProviderSolver) cleanUpDynamicDns(ctx context.Context, hc *utils.HeClient, ch *v1alpha1.ChallengeRequest) error {
+	hostname := dynamicDnsHostname(ch)
+	if !c.ddnsLocks.release(hostname, ch.Key) {
+		klog.FromContext(ctx).Info("Not resetting dynamic-dns record, it's in use by another challenge", "hostname", hostname)
+		return nil
+	}
+	if err := c.ddnsCooldowns.check(hostname); err != nil {
+		return err
+	}
+	err := hc.RemoveTxtRecordWithDynamicDns(ctx, ch)
+	c.ddnsCooldowns.update(ctx, hostname, hc.AuditSubject.Credentials, err)
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+func TestDynamicDnsLocks(t *testing.T) {
+	l := dynamicDnsLocks{}
+	ctx := context.Background()
+
+	if err := l.acquire(ctx, "_acme-challenge.example.com", "first", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.acquire(ctx, "_acme-challenge.example.com", "first", time.Minute); err != nil {
+		t.Errorf("presenting the same challenge again failed: %v", err)
+	}
+	if err := l.acquire(ctx, "_acme-challenge.example.com", "second", time.Minute); !errors.Is(err, errRecordInUse) {
+		t.Errorf("got %v for another challenge, want the record in use", err)
+	}
+	if err := l.acquire(ctx, "_acme-challenge.example.org", "second", time.Minute); err != nil {
+		t.Errorf("another record is locked too: %v", err)
+	}
+
+	if l.release("_acme-challenge.example.com", "second") {
+		t.Errorf("a challenge released the record of another one")
+	}
+	if !l.release("_acme-challenge.example.com", "first") {
+		t.Errorf("the holder cannot release the record")
+	}
+	if !l.release("_acme-challenge.example.com", "first") {
+		t.Errorf("a free record cannot be reset")
+	}
+
+	// records that were not cleaned up are taken over after the timeout
+	if err := l.acquire(ctx, "_acme-challenge.example.com", "first", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	l.holders["_acme-challenge.example.com"] = dynamicDnsHolder{key: "first", since: time.Now().Add(-2 * time.Minute)}
+	l.mu.Unlock()
+	if err := l.acquire(ctx, "_acme-challenge.example.com", "second", time.Minute); err != nil {
+		t.Errorf("the record was not taken over after the timeout: %v", err)
+	}
+	if l.release("_acme-challenge.example.com", "first") {
+		t.Errorf("the previous holder released the record it lost")
+	}
+}
+
+func TestDynamicDnsCooldowns(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{name: "abuse", err: &utils.DynamicDnsError{Code: utils.DynamicDnsAbuse}, want: dynamicDnsAbuseCooldown},
+		{name: "interval", err: fmt.Errorf("wrapped: %w", &utils.DynamicDnsError{Code: utils.DynamicDnsInterval}), want: dynamicDnsIntervalCooldown},
+		{name: "badauth", err: &utils.DynamicDnsError{Code: utils.DynamicDnsBadAuth}},
+		{name: "other error", err: errors.New("connection refused")},
+		{name: "success"},
+	}
+	for _, tt := range tests {
+		c := dynamicDnsCooldowns{}
+		c.update(ctx, "_acme-challenge.example.com", "secret certs/ddns", tt.err)
+		err := c.check("_acme-challenge.example.com")
+		if tt.want == 0 {
+			if err != nil {
+				t.Errorf("%v: updates paused: %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, errDynamicDnsPaused) {
+			t.Errorf("%v: got %v, want the updates paused", tt.name, err)
+			continue
+		}
+		if until := c.cooldowns["_acme-challenge.example.com"].until; time.Until(until) > tt.want || time.Until(until) < tt.want-time.Minute {
+			t.Errorf("%v: paused until %v, want %v from now", tt.name, until, tt.want)
+		}
+		if err := c.check("_acme-challenge.example.org"); err != nil {
+			t.Errorf("%v: another record is paused too: %v", tt.name, err)
+		}
+	}
+
+	// expired
+	c := dynamicDnsCooldowns{cooldowns: map[string]dynamicDnsCooldown{
+		"_acme-challenge.example.com": {until: time.Now().Add(-time.Second)},
+	}}
+	if err := c.check("_acme-challenge.example.com"); err != nil {
+		t.Errorf("an expired pause is still active: %v", err)
+	}
+
+	// cleared when the credentials change
+	c.update(ctx, "_acme-challenge.example.com", "secret certs/ddns", &utils.DynamicDnsError{Code: utils.DynamicDnsAbuse})
+	c.update(ctx, "_acme-challenge.example.org", "secret certs/other", &utils.DynamicDnsError{Code: utils.DynamicDnsAbuse})
+	c.clear("secret certs/ddns")
+	if err := c.check("_acme-challenge.example.com"); err != nil {
+		t.Errorf("the pause was kept after the credentials changed: %v", err)
+	}
+	if err := c.check("_acme-challenge.example.org"); err == nil {
+		t.Errorf("the pause of other credentials was cleared")
+	}
+}
+
+func TestCleanUpDynamicDnsPaused(t *testing.T) {
+	ddns := newFakeDynamicDns(t, "ddns-key")
+	c := &heProviderSolver{config: testConfigStore(t, nil)}
+	hc := &utils.HeClient{ApiKey: "ddns-key", HeUrl: ddns.URL + "/", Method: "dynamic-dns", Client: &http.Client{}}
+	ctx := context.Background()
+	first := testChallengeRequest()
+	second := testChallengeRequest()
+	second.Key = "other-key"
+
+	if err := c.presentDynamicDns(ctx, hc, first); err != nil {
+		t.Fatal(err)
+	}
+	c.ddnsCooldowns.update(ctx, dynamicDnsHostname(first), "", &utils.DynamicDnsError{Code: utils.DynamicDnsInterval})
+
+	updates := ddns.updateCount()
+	if err := c.cleanUpDynamicDns(ctx, hc, first); !errors.Is(err, errDynamicDnsPaused) {
+		t.Errorf("got %v, want the updates paused", err)
+	}
+	if ddns.updateCount() != updates {
+		t.Errorf("HE was contacted while paused")
+	}
+	// the record is free for the next challenge anyway
+	if err := c.ddnsLocks.acquire(ctx, dynamicDnsHostname(second), second.Key, time.Hour); err != nil {
+		t.Errorf("the record is still locked after a paused CleanUp: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+// delegationCache remembers the result of the delegation check of each zone
+type delegationCache struct {
+	mu      sync.Mutex
+	results map[string]delegationResult
+}
+
+type delegationResult struct {
+	// the delegation problem, if any
+	err       error
+	checkedAt time.Time
+}
+
+// get returns the cached result for zone, if it's not older than ttl: ok
+// tells whether there is one, and err is the problem it found
+func (d *delegationCache) get(zone string, ttl time.Duration) (ok bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.results[zone]
+	if !ok || time.Since(r.checkedAt) > ttl {
+		return false, nil
+	}
+	return true, r.err
+}
+
+func (d *delegationCache) set(zone string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.results == nil {
+		d.results = map[string]delegationResult{}
+	}
+	d.results[zone] = delegationResult{err: err, checkedAt: time.Now()}
+}
+
+// checkDelegation makes sure the challenge zone is delegated to HE, since
+// otherwise the records we create are never seen by the ACME server. A
+// problem is logged, and returned as an error only in "fail" mode. If the
+// NS records cannot be resolved, the challenge goes on.
+func (c *heProviderSolver) checkDelegation(ctx context.Context, ch *v1alpha1.ChallengeRequest) error {
+
+	logger := klog.FromContext(ctx)
+	settings := c.config.Get()
+	if settings.DelegationCheck == "off" {
+		return nil
+	}
+
+	zone := strings.ToLower(strings.TrimSuffix(ch.ResolvedZone, "."))
+	cached, problem := c.delegation.get(zone, settings.DelegationCheckTTL.Duration)
+	if !cached {
+		nameservers, err := utils.LookupNS(ctx, settings.Resolvers, zone)
+		if err != nil {
+			logger.Error(err, "Cannot check the delegation of the zone", "zone", zone)
+			return nil
+		}
+		problem = utils.CheckDelegation(zone, nameservers)
+		c.delegation.set(zone, problem)
+		if problem == nil {
+			logger.V(2).Info("Zone is delegated to HE", "zone", zone, "nameservers", nameservers)
+		}
+	}
+	if problem == nil {
+		return nil
+	}
+
+	if settings.DelegationCheck == "fail" {
+		return problem
+	}
+	logger.Info("Zone delegation problem, going on anyway", "zone", zone, "problem", problem.Error())
+	c.events.event(ch, corev1.EventTypeWarning, reasonZoneNotDelegated, problem.Error())
+	return nil
+}
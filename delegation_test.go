@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+	"github.com/waldner/cert-manager-webhook-he/utils/hetest"
+)
+
+func TestCheckDelegation(t *testing.T) {
+	he := hetest.NewServer(t, "user", "pass", "example.com")
+	resolver := he.DNSServer()
+	ctx := context.Background()
+	ch := testChallengeRequest()
+
+	tests := []struct {
+		name       string
+		mode       string
+		delegation []string
+		resolvers  []string
+		wantErr    bool
+		// whether the result is cached
+		wantCached bool
+	}{
+		{name: "delegated", mode: "fail", wantCached: true},
+		{name: "not delegated, fail", mode: "fail", delegation: []string{"ns1.registrar.example."}, wantErr: true, wantCached: true},
+		{name: "not delegated, warn", mode: "warn", delegation: []string{"ns1.registrar.example."}, wantCached: true},
+		{name: "partly delegated, fail", mode: "fail", delegation: []string{"ns1.he.net.", "ns1.registrar.example."}, wantErr: true, wantCached: true},
+		{name: "off", mode: "off", delegation: []string{"ns1.registrar.example."}},
+		{name: "no resolver answers", mode: "fail", resolvers: []string{"127.0.0.1:1"}},
+	}
+	for _, tt := range tests {
+		he.SetDelegation(tt.delegation...)
+		resolvers := tt.resolvers
+		if resolvers == nil {
+			resolvers = []string{resolver}
+		}
+		c := &heProviderSolver{config: testConfigStore(t, func(c *webhookConfig) {
+			c.DelegationCheck = tt.mode
+			c.Resolvers = resolvers
+		})}
+
+		err := c.checkDelegation(ctx, ch)
+		if tt.wantErr != (err != nil) {
+			t.Errorf("%v: got %v, want an error: %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, utils.ErrNotDelegated) {
+			t.Errorf("%v: got %v, want a delegation error", tt.name, err)
+		}
+		if cached, _ := c.delegation.get("example.com", time.Hour); cached != tt.wantCached {
+			t.Errorf("%v: got cached=%v, want %v", tt.name, cached, tt.wantCached)
+		}
+	}
+}
+
+func TestCheckDelegationCache(t *testing.T) {
+	he := hetest.NewServer(t, "user", "pass", "example.com")
+	ctx := context.Background()
+	ch := testChallengeRequest()
+	c := &heProviderSolver{config: testConfigStore(t, func(c *webhookConfig) {
+		c.DelegationCheck = "fail"
+		c.Resolvers = []string{he.DNSServer()}
+	})}
+
+	if err := c.checkDelegation(ctx, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delegation changes, but the result is cached for the TTL
+	he.SetDelegation("ns1.registrar.example.")
+	if err := c.checkDelegation(ctx, ch); err != nil {
+		t.Errorf("the cached result was not used: %v", err)
+	}
+
+	c.delegation.mu.Lock()
+	r := c.delegation.results["example.com"]
+	r.checkedAt = time.Now().Add(-c.config.Get().DelegationCheckTTL.Duration - time.Minute)
+	c.delegation.results["example.com"] = r
+	c.delegation.mu.Unlock()
+	if err := c.checkDelegation(ctx, ch); !errors.Is(err, utils.ErrNotDelegated) {
+		t.Errorf("got %v after the TTL, want the delegation checked again", err)
+	}
+
+	// problems are cached too
+	he.SetDelegation()
+	if err := c.checkDelegation(ctx, ch); !errors.Is(err, utils.ErrNotDelegated) {
+		t.Errorf("got %v, want the cached problem", err)
+	}
+}
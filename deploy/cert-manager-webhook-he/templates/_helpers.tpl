@@ -81,6 +81,9 @@ rules:
       - 'get'
       - 'watch'
       - 'list'
+{{- if $root.Values.rbac.allowSecretUpdates }}
+      - 'update'
+{{- end }}
 ---
 apiVersion: rbac.authorization.k8s.io/v1
 kind: {{ $bindingType }}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	cmacme "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmclient "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned"
+	cminformers "github.com/cert-manager/cert-manager/pkg/client/informers/externalversions"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+// event reasons
+const (
+	reasonPresented         = "Presented"
+	reasonCleanedUp         = "CleanedUp"
+	reasonPresentFailed     = "PresentFailed"
+	reasonCleanUpFailed     = "CleanUpFailed"
+	reasonLoginFailed       = "LoginFailed"
+	reasonZoneNotFound      = "ZoneNotFound"
+	reasonZoneNotDelegated  = "ZoneNotDelegated"
+	reasonPageLayoutChanged = "PageLayoutChanged"
+	reasonRecordInUse       = "RecordInUse"
+	reasonDynamicDnsPaused  = "DynamicDnsPaused"
+	reasonInvalidConfig     = "InvalidConfig"
+)
+
+// name of the index of the Challenges by spec.key
+const challengeKeyIndex = "challengeKey"
+
+// eventRecorder records Kubernetes events about the challenges, on the
+// Challenge resource if it can be found, and on its namespace otherwise
+type eventRecorder struct {
+	recorder record.EventRecorder
+	// the Challenges, from a shared informer, indexed by challengeKeyIndex
+	challenges cache.Indexer
+	synced     cache.InformerSynced
+}
+
+// newEventRecorder starts sending events to the API server, until stopCh is
+// closed
+func newEventRecorder(config *rest.Config, cl kubernetes.Interface, stopCh <-chan struct{}) (*eventRecorder, error) {
+
+	cmcl, err := cmclient.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cert-manager client: %v", err)
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cert-manager-webhook-he"})
+	return newChallengeEventRecorder(recorder, cmcl, stopCh)
+}
+
+// newChallengeEventRecorder returns an eventRecorder finding the Challenges
+// through an informer, which runs until stopCh is closed. Until the informer
+// has synced, the events go to the namespace.
+func newChallengeEventRecorder(recorder record.EventRecorder, cmcl cmclient.Interface, stopCh <-chan struct{}) (*eventRecorder, error) {
+
+	factory := cminformers.NewSharedInformerFactory(cmcl, 0)
+	informer := factory.Acme().V1().Challenges().Informer()
+	err := informer.AddIndexers(cache.Indexers{challengeKeyIndex: func(obj interface{}) ([]string, error) {
+		c, ok := obj.(*cmacme.Challenge)
+		if !ok {
+			return nil, nil
+		}
+		return []string{c.Spec.Key}, nil
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("error indexing challenges: %v", err)
+	}
+	factory.Start(stopCh)
+
+	return &eventRecorder{
+		recorder:   recorder,
+		challenges: informer.GetIndexer(),
+		synced:     informer.HasSynced,
+	}, nil
+}
+
+// event records an event about the challenge. A nil recorder does nothing.
+func (e *eventRecorder) event(ch *v1alpha1.ChallengeRequest, eventType, reason, message string) {
+	if e == nil {
+		return
+	}
+	e.recorder.Event(e.involvedObject(ch), eventType, reason, message)
+}
+
+// outcome records the result of a Present or CleanUp call
+func (e *eventRecorder) outcome(ch *v1alpha1.ChallengeRequest, operation string, method string, err error) {
+	fqdn := strings.TrimSuffix(ch.ResolvedFQDN, ".")
+	if err == nil {
+		if operation == "present" {
+			e.event(ch, corev1.EventTypeNormal, reasonPresented, fmt.Sprintf("Presented TXT record %v with the %v method", fqdn, method))
+		} else {
+			e.event(ch, corev1.EventTypeNormal, reasonCleanedUp, fmt.Sprintf("Cleaned up TXT record %v with the %v method", fqdn, method))
+		}
+		return
+	}
+	e.event(ch, corev1.EventTypeWarning, failureReason(operation, err), fmt.Sprintf("%v of TXT record %v failed: %v", operationName(operation), fqdn, err))
+}
+
+func operationName(operation string) string {
+	if operation == "present" {
+		return "Present"
+	}
+	return "CleanUp"
+}
+
+// failureReason classifies an error, so that the reason tells what to fix
+func failureReason(operation string, err error) string {
+	var de *utils.DynamicDnsError
+	switch {
+	case errors.Is(err, errInvalidConfig):
+		return reasonInvalidConfig
+	case errors.Is(err, utils.ErrLoginFailed):
+		return reasonLoginFailed
+	case errors.Is(err, utils.ErrZoneNotFound):
+		return reasonZoneNotFound
+	case errors.Is(err, utils.ErrNotDelegated):
+		return reasonZoneNotDelegated
+	case utils.IsLayoutError(err):
+		return reasonPageLayoutChanged
+	case errors.Is(err, errRecordInUse):
+		return reasonRecordInUse
+	case errors.Is(err, errDynamicDnsPaused):
+		return reasonDynamicDnsPaused
+	case errors.As(err, &de) && de.Code != "":
+		return "DynamicDns" + strings.ToUpper(de.Code[:1]) + de.Code[1:]
+	}
+	if operation == "present" {
+		return reasonPresentFailed
+	}
+	return reasonCleanUpFailed
+}
+
+// involvedObject returns a reference to the Challenge the request is for, or
+// to its namespace if the Challenge cannot be found. cert-manager doesn't
+// pass the Challenge in the request, so it's found by its key (which the
+// wildcard and non-wildcard Challenges of an order can share) and DNS name.
+// The namespace isn't used: for a ClusterIssuer, the request has the cluster
+// resource namespace, not the one of the Certificate and its Challenges.
+func (e *eventRecorder) involvedObject(ch *v1alpha1.ChallengeRequest) *corev1.ObjectReference {
+
+	if e.synced() && ch.Key != "" {
+		objs, err := e.challenges.ByIndex(challengeKeyIndex, ch.Key)
+		if err != nil {
+			klog.V(2).InfoS("Cannot look up the challenge for events", "namespace", ch.ResourceNamespace, "err", err)
+		}
+		var found *cmacme.Challenge
+		for _, obj := range objs {
+			c := obj.(*cmacme.Challenge)
+			// should there be several, prefer the one in the request namespace
+			if c.Spec.DNSName == ch.DNSName && (found == nil || c.Namespace == ch.ResourceNamespace) {
+				found = c
+			}
+		}
+		if found != nil {
+			return &corev1.ObjectReference{
+				APIVersion:      cmacme.SchemeGroupVersion.String(),
+				Kind:            "Challenge",
+				Namespace:       found.Namespace,
+				Name:            found.Name,
+				UID:             found.UID,
+				ResourceVersion: found.ResourceVersion,
+			}
+		}
+	}
+
+	namespace := ch.ResourceNamespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	// namespaces are cluster-scoped, but the recorder creates the event in
+	// the namespace of the involved object
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       namespace,
+		Namespace:  namespace,
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	cmacme "github.com/cert-manager/cert-manager/pkg/apis/acme/v1"
+	cmfake "github.com/cert-manager/cert-manager/pkg/client/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func testChallenge(namespace, name, key, dnsName string) *cmacme.Challenge {
+	return &cmacme.Challenge{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID("uid-" + name)},
+		Spec:       cmacme.ChallengeSpec{Key: key, DNSName: dnsName},
+	}
+}
+
+func TestEventInvolvedObject(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	cmcl := cmfake.NewSimpleClientset(
+		// the wildcard and non-wildcard challenges of an order share the key
+		testChallenge("certs", "example-plain", "challenge-key", "example.com"),
+		testChallenge("certs", "example-wildcard", "challenge-key", "*.example.com"),
+		testChallenge("certs", "www", "other-key", "www.example.com"),
+		// for a ClusterIssuer, in the namespace of the Certificate
+		testChallenge("apps", "cluster-issued", "cluster-key", "apps.example.com"),
+		testChallenge("apps", "same-key-elsewhere", "shared-key", "shared.example.com"),
+		testChallenge("certs", "same-key", "shared-key", "shared.example.com"),
+	)
+	e, err := newChallengeEventRecorder(record.NewFakeRecorder(10), cmcl, stopCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.WaitForCacheSync(stopCh, e.synced) {
+		t.Fatal("the informer didn't sync")
+	}
+
+	tests := []struct {
+		name          string
+		ch            *v1alpha1.ChallengeRequest
+		wantKind      string
+		wantName      string
+		wantNamespace string
+	}{
+		{
+			name:          "challenge",
+			ch:            &v1alpha1.ChallengeRequest{ResourceNamespace: "certs", Key: "challenge-key", DNSName: "example.com"},
+			wantKind:      "Challenge",
+			wantName:      "example-plain",
+			wantNamespace: "certs",
+		},
+		{
+			name:          "wildcard challenge",
+			ch:            &v1alpha1.ChallengeRequest{ResourceNamespace: "certs", Key: "challenge-key", DNSName: "*.example.com"},
+			wantKind:      "Challenge",
+			wantName:      "example-wildcard",
+			wantNamespace: "certs",
+		},
+		{
+			name:          "cluster issuer challenge",
+			ch:            &v1alpha1.ChallengeRequest{ResourceNamespace: "cert-manager", Key: "cluster-key", DNSName: "apps.example.com"},
+			wantKind:      "Challenge",
+			wantName:      "cluster-issued",
+			wantNamespace: "apps",
+		},
+		{
+			name:          "same key in several namespaces",
+			ch:            &v1alpha1.ChallengeRequest{ResourceNamespace: "certs", Key: "shared-key", DNSName: "shared.example.com"},
+			wantKind:      "Challenge",
+			wantName:      "same-key",
+			wantNamespace: "certs",
+		},
+		{
+			name:          "unknown challenge",
+			ch:            &v1alpha1.ChallengeRequest{ResourceNamespace: "certs", Key: "missing-key", DNSName: "example.com"},
+			wantKind:      "Namespace",
+			wantName:      "certs",
+			wantNamespace: "certs",
+		},
+		{
+			name:          "no namespace",
+			ch:            &v1alpha1.ChallengeRequest{Key: "missing-key", DNSName: "example.com"},
+			wantKind:      "Namespace",
+			wantName:      "default",
+			wantNamespace: "default",
+		},
+	}
+	for _, tt := range tests {
+		ref := e.involvedObject(tt.ch)
+		if ref.Kind != tt.wantKind || ref.Name != tt.wantName || ref.Namespace != tt.wantNamespace {
+			t.Errorf("%v: got %v %v/%v, want %v %v/%v", tt.name, ref.Kind, ref.Namespace, ref.Name, tt.wantKind, tt.wantNamespace, tt.wantName)
+		}
+		if ref.Kind == "Challenge" && string(ref.UID) != "uid-"+ref.Name {
+			t.Errorf("%v: got UID %q", tt.name, ref.UID)
+		}
+	}
+
+	// challenges created later are found too
+	created := testChallenge("certs", "late", "late-key", "late.example.com")
+	if _, err := cmcl.AcmeV1().Challenges("certs").Create(context.Background(), created, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollUntilContextTimeout(context.Background(), 10*time.Millisecond, 5*time.Second, true, func(ctx context.Context) (bool, error) {
+		return e.involvedObject(&v1alpha1.ChallengeRequest{ResourceNamespace: "certs", Key: "late-key", DNSName: "late.example.com"}).Name == "late", nil
+	})
+	if err != nil {
+		t.Errorf("the new challenge was not found: %v", err)
+	}
+}
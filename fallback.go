@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// how long to remember the fallback used for a challenge whose CleanUp
+// never comes
+const fallbackPathTTL = 24 * time.Hour
+
+// fallbackConfig is an alternative way of updating the TXT record, used when
+// login mode fails because the HE pages cannot be parsed (eg, after a change
+// in the control panel). The record must have been pre-created for dynamic
+// DNS, like for the dynamic-dns method.
+type fallbackConfig struct {
+	// only "dynamic-dns" is supported
+	Method          string    `json:"method"`
+	HeUrl           string    `json:"heUrl"`
+	ApiKeySecretRef secretRef `json:"apiKeySecretRef"`
+}
+
+// fallbackConfig returns the solver config for the i-th fallback. It uses the same
+// credential provider as the main config.
+func (cfg heProviderConfig) fallbackConfig(i int) heProviderConfig {
+	fb := cfg.Fallback[i]
+	return heProviderConfig{
+		Method:             "dynamic-dns",
+		HeUrl:              fb.HeUrl,
+		ApiKeySecretRef:    fb.ApiKeySecretRef,
+		CredentialProvider: cfg.CredentialProvider,
+		Exec:               cfg.Exec,
+	}
+}
+
+// presentWithFallback tries the fallbacks in order after login mode failed
+// with loginErr, remembering the one that worked for CleanUp. It returns the
+// method the record was set with, or login (which failed) if none worked.
+func (c *heProviderSolver) presentWithFallback(ctx context.Context, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest, loginErr error) (string, error) {
+
+	logger := klog.FromContext(ctx)
+	logger.Info("Login mode failed, trying fallbacks", "fqdn", ch.ResolvedFQDN, "reason", loginErr)
+
+	for i := range cfg.Fallback {
+		hc, _, err := c.newClient(ctx, cfg.fallbackConfig(i), c.config.Get(), ch)
+		if err == nil {
+			err = c.presentDynamicDns(ctx, hc, ch)
+		}
+		if err != nil {
+			logger.Error(err, "Fallback failed", "fqdn", ch.ResolvedFQDN, "fallback", i)
+			continue
+		}
+		logger.Info("Presented record through fallback", "fqdn", ch.ResolvedFQDN, "fallback", i, "method", hc.Method)
+		c.events.event(ch, corev1.EventTypeWarning, reasonPageLayoutChanged, fmt.Sprintf("Login mode failed (%v), presented the record through fallback %d (%v)", loginErr, i, hc.Method))
+		c.fallbacks.remember(ch, i)
+		return hc.Method, nil
+	}
+
+	return "login", fmt.Errorf("%v (all fallbacks failed too)", loginErr)
+}
+
+// cleanUpWithFallback removes the record through fallback i, returning the
+// method used like presentWithFallback
+func (c *heProviderSolver) cleanUpWithFallback(ctx context.Context, cfg heProviderConfig, i int, ch *v1alpha1.ChallengeRequest) (string, error) {
+	hc, fbCfg, err := c.newClient(ctx, cfg.fallbackConfig(i), c.config.Get(), ch)
+	if err != nil {
+		return fbCfg.Method, err
+	}
+	klog.FromContext(ctx).Info("Cleaning up record through fallback", "fqdn", ch.ResolvedFQDN, "fallback", i, "method", hc.Method)
+	return hc.Method, c.cleanUpDynamicDns(ctx, hc, ch)
+}
+
+// fallbackPaths remembers which challenges were presented through which
+// fallback, so that CleanUp goes the same way
+type fallbackPaths struct {
+	mu    sync.Mutex
+	paths map[string]fallbackPath
+}
+
+type fallbackPath struct {
+	index int
+	since time.Time
+}
+
+func (f *fallbackPaths) remember(ch *v1alpha1.ChallengeRequest, index int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.paths == nil {
+		f.paths = map[string]fallbackPath{}
+	}
+	for id, p := range f.paths {
+		if time.Since(p.since) > fallbackPathTTL {
+			delete(f.paths, id)
+		}
+	}
+	f.paths[challengeId(ch)] = fallbackPath{index: index, since: time.Now()}
+}
+
+// take returns (and forgets) the fallback used to present the challenge, if any
+func (f *fallbackPaths) take(ch *v1alpha1.ChallengeRequest) (int, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.paths[challengeId(ch)]
+	delete(f.paths, challengeId(ch))
+	return p.index, ok
+}
+
+// identifies a challenge across its Present and CleanUp calls
+func challengeId(ch *v1alpha1.ChallengeRequest) string {
+	return ch.ResolvedFQDN + "|" + ch.Key
+}
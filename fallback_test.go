@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+// fakeDynamicDns is a dyndns2 endpoint like HE's, with a single key for all
+// the records
+type fakeDynamicDns struct {
+	*httptest.Server
+	key string
+
+	mu      sync.Mutex
+	records map[string]string
+	// if set, the answer to every update
+	answer  string
+	updates int
+}
+
+func newFakeDynamicDns(t *testing.T, key string) *fakeDynamicDns {
+	f := &fakeDynamicDns{key: key, records: map[string]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.updates++
+
+		hostname := r.FormValue("hostname")
+		switch {
+		case r.URL.Path != "/nic/update":
+			http.NotFound(w, r)
+		case f.answer != "":
+			fmt.Fprint(w, f.answer)
+		case r.FormValue("password") != f.key:
+			fmt.Fprint(w, "badauth")
+		default:
+			f.records[hostname] = r.FormValue("txt")
+			fmt.Fprint(w, "good 127.0.0.1")
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeDynamicDns) record(hostname string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.records[hostname]
+}
+
+func (f *fakeDynamicDns) setAnswer(answer string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answer = answer
+}
+
+func (f *fakeDynamicDns) updateCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.updates
+}
+
+// testConfigStore serves the default config, changed by modify. The
+// nameservers are cleared, so that nothing is looked up in the real DNS.
+func testConfigStore(t *testing.T, modify func(*webhookConfig)) *configStore {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	cfg := defaultWebhookConfig()
+	cfg.Nameservers = nil
+	cfg.DelegationCheck = "off"
+	if modify != nil {
+		modify(cfg)
+	}
+	s := &configStore{}
+	s.current.Store(cfg)
+	return s
+}
+
+func TestFallbackValidationUsesAccountProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name: "account with secrets under an exec top level",
+			config: `{"credentialProvider": "exec", "exec": {"plugin": "vault"},
+				"accounts": [{"zones": ["example.com"], "credentialProvider": "secret", "credentialsSecretRef": {"name": "he"}}],
+				"fallback": [{"apiKeySecretRef": {"name": "ddns"}}]}`,
+		},
+		{
+			name: "account with exec under a secret top level",
+			config: `{"credentialProvider": "secret",
+				"accounts": [{"zones": ["example.com"], "credentialProvider": "exec", "exec": {"plugin": "vault"}}],
+				"fallback": [{"apiKeySecretRef": {"name": "ddns"}}]}`,
+			wantErr: "fallback[0]: secret references cannot be used with the exec credential provider",
+		},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(&extapi.JSON{Raw: []byte(tt.config)}, "login")
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.wantErr)
+		} else if strings.Count(err.Error(), tt.wantErr) != 1 {
+			t.Errorf("%v: problem reported more than once: %v", tt.name, err)
+		}
+	}
+
+	// the fallback secret is checked against the policy when the account
+	// reads secrets, even if the default provider doesn't
+	t.Setenv("SECRET_NAMES", "he")
+	settings := testConfigStore(t, func(c *webhookConfig) { c.CredentialProvider = "env" }).Get()
+	raw := &extapi.JSON{Raw: []byte(`{"accounts": [{"zones": ["example.com"], "credentialProvider": "secret", "credentialsSecretRef": {"name": "he"}}],
+		"fallback": [{"apiKeySecretRef": {"name": "ddns"}}]}`)}
+	if err := validateSolverConfig(raw, settings, "certs"); err == nil || !strings.Contains(err.Error(), "certs/ddns") {
+		t.Errorf("got %v, want the fallback secret to be rejected", err)
+	}
+}
+
+func TestPresentAndCleanUpWithFallback(t *testing.T) {
+	t.Setenv("HE_APIKEY", "ddns-key")
+	broken := newFakeDynamicDns(t, "ddns-key")
+	broken.setAnswer("911")
+	working := newFakeDynamicDns(t, "ddns-key")
+
+	c := &heProviderSolver{config: testConfigStore(t, func(c *webhookConfig) { c.CredentialProvider = "env" })}
+	ctx := context.Background()
+	ch := testChallengeRequest()
+	ch.Config = &extapi.JSON{Raw: []byte(fmt.Sprintf(`{"method": "login", "fallback": [{"heUrl": %q}, {"heUrl": %q}]}`, broken.URL, working.URL))}
+
+	_, cfg, err := c.initConfig(ctx, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginErr := fmt.Errorf("the login page has changed")
+	method, err := c.presentWithFallback(ctx, cfg, ch, loginErr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// for the metrics, the span and the event
+	if method != "dynamic-dns" {
+		t.Errorf("got method %v, want the one of the fallback", method)
+	}
+	if got := working.record("_acme-challenge.example.com"); got != ch.Key {
+		t.Fatalf("record is %q after Present, want the challenge key", got)
+	}
+
+	// CleanUp goes through the fallback that worked, without logging in
+	if err := c.CleanUp(ch); err != nil {
+		t.Fatal(err)
+	}
+	if got := working.record("_acme-challenge.example.com"); got != "UNUSED" {
+		t.Errorf("record is %q after CleanUp, want the placeholder", got)
+	}
+	if _, ok := c.fallbacks.take(ch); ok {
+		t.Errorf("the fallback path was kept after CleanUp")
+	}
+
+	// all the fallbacks failing
+	working.setAnswer("911")
+	method, err = c.presentWithFallback(ctx, cfg, ch, loginErr)
+	if method != "login" {
+		t.Errorf("got method %v when all the fallbacks failed, want login", method)
+	}
+	if err == nil || !strings.Contains(err.Error(), "the login page has changed (all fallbacks failed too)") {
+		t.Errorf("got %v, want the login error", err)
+	}
+	if _, ok := c.fallbacks.take(ch); ok {
+		t.Errorf("a fallback path was remembered although none worked")
+	}
+}
+
+func TestFallbackPaths(t *testing.T) {
+	f := fallbackPaths{}
+	first := testChallengeRequest()
+	// same name, another challenge (eg, the wildcard one)
+	second := testChallengeRequest()
+	second.Key = "other-key"
+
+	f.remember(first, 1)
+	f.remember(second, 0)
+	if i, ok := f.take(first); !ok || i != 1 {
+		t.Errorf("got fallback %v (%v) for the first challenge, want 1", i, ok)
+	}
+	if _, ok := f.take(first); ok {
+		t.Errorf("the path can be taken twice")
+	}
+
+	// paths whose CleanUp never came are forgotten after a while
+	f.mu.Lock()
+	p := f.paths[challengeId(second)]
+	p.since = time.Now().Add(-fallbackPathTTL - time.Minute)
+	f.paths[challengeId(second)] = p
+	f.mu.Unlock()
+
+	third := &v1alpha1.ChallengeRequest{ResolvedFQDN: "_acme-challenge.example.org.", Key: "third-key"}
+	f.remember(third, 0)
+	if _, ok := f.take(second); ok {
+		t.Errorf("an expired path was kept")
+	}
+	if _, ok := f.take(third); !ok {
+		t.Errorf("the new path was not remembered")
+	}
+}
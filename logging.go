@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"k8s.io/klog/v2"
+)
+
+// challengeContext returns the context for a Present or CleanUp call, with a
+// logger that tags every line with the challenge, so that the lines of
+// concurrent challenges can be told apart. Everything down the call chain,
+// including the HE client, should log through klog.FromContext.
+func challengeContext(ch *v1alpha1.ChallengeRequest) context.Context {
+	logger := klog.LoggerWithValues(klog.Background(),
+		"challenge", challengeTag(ch),
+		"fqdn", ch.ResolvedFQDN,
+		"dnsName", ch.DNSName,
+		"namespace", ch.ResourceNamespace,
+	)
+	return klog.NewContext(context.Background(), logger)
+}
+
+// challengeTag returns a short identifier of the challenge, the same in its
+// Present and CleanUp calls. cert-manager doesn't pass the Challenge's UID,
+// so it's a hash of the record name and the key, which tells apart the
+// wildcard and non-wildcard challenges of a name without logging the key.
+func challengeTag(ch *v1alpha1.ChallengeRequest) string {
+	sum := sha256.Sum256([]byte(challengeId(ch)))
+	return hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestChallengeTag(t *testing.T) {
+	ch := testChallengeRequest()
+	tag := challengeTag(ch)
+	if len(tag) != 12 {
+		t.Errorf("got tag %q, want 12 hex digits", tag)
+	}
+
+	// the CleanUp request is a new object with the same fields
+	if again := challengeTag(testChallengeRequest()); again != tag {
+		t.Errorf("got %q for the same challenge, want %q", again, tag)
+	}
+
+	// the wildcard challenge uses the same record with another key
+	wildcard := testChallengeRequest()
+	wildcard.Key = "wildcard-key"
+	wildcard.DNSName = "*.example.com"
+	if challengeTag(wildcard) == tag {
+		t.Errorf("the wildcard challenge has the same tag")
+	}
+
+	other := testChallengeRequest()
+	other.ResolvedFQDN = "_acme-challenge.example.org."
+	if challengeTag(other) == tag {
+		t.Errorf("a challenge for another record has the same tag")
+	}
+}
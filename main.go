@@ -4,12 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"net/http/cookiejar"
 	"os"
+	"reflect"
+	"time"
 
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
@@ -21,21 +21,37 @@ import (
 	"github.com/waldner/cert-manager-webhook-he/utils"
 )
 
-var GroupName = os.Getenv("GROUP_NAME")
-
 func main() {
 
-	if GroupName == "" {
-		panic("GROUP_NAME must be specified")
+	if len(os.Args) > 1 && os.Args[1] == "provision-ddns" {
+		if err := runProvision(os.Args[2:]); err != nil {
+			klog.ErrorS(err, "Provisioning failed")
+			os.Exit(1)
+		}
+		return
+	}
+
+	config, err := newConfigStore(os.Getenv("HE_CONFIG_FILE"))
+	if err != nil {
+		klog.ErrorS(err, "Cannot start the webhook")
+		os.Exit(1)
 	}
 
+	snapshots := utils.NewSnapshotStore(config.Get().DebugSnapshots)
+
+	startAdmissionServer(config)
+	startMetricsServer()
+	startDebugServer(snapshots)
+	stopTracing := startTracing()
+	defer stopTracing()
+
 	// This will register our custom DNS provider with the webhook serving
 	// library, making it available as an API under the provided GroupName.
 	// You can register multiple DNS provider implementations with a single
 	// webhook, where the Name() method will be used to disambiguate between
 	// the different implementations.
-	cmd.RunWebhookServer(GroupName,
-		&heProviderSolver{},
+	cmd.RunWebhookServer(config.Get().GroupName,
+		&heProviderSolver{config: config, snapshots: snapshots},
 	)
 }
 
@@ -51,12 +67,48 @@ type heProviderSolver struct {
 	// 3. uncomment the relevant code in the Initialize method below
 	// 4. ensure your webhook's service account has the required RBAC role
 	//    assigned to it for interacting with the Kubernetes APIs you need.
-	client *kubernetes.Clientset
+	client kubernetes.Interface
+
+	// credential secrets, served from informers
+	secrets *secretCache
+
+	// credentials read from files, if configured
+	files *fileCredentials
+
+	// webhook-wide settings and defaults
+	config *configStore
+
+	// challenges presented through a fallback method
+	fallbacks fallbackPaths
+
+	// dynamic-dns records in use by a challenge
+	ddnsLocks dynamicDnsLocks
+	// dynamic-dns records HE asked us to stop updating for a while
+	ddnsCooldowns dynamicDnsCooldowns
+
+	// results of the zone delegation checks
+	delegation delegationCache
+
+	// Kubernetes events about the challenges; nil if they cannot be recorded
+	events *eventRecorder
+
+	// where the changes to DNS records are recorded
+	audit auditLogs
+
+	// snapshots of unexpected HE pages, when enabled
+	snapshots *utils.SnapshotStore
 }
 
 type secretRef struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
+
+	// optional names of the keys holding the credentials in the secret data,
+	// for secrets that don't follow our naming
+	UsernameKey   string `json:"usernameKey"`
+	PasswordKey   string `json:"passwordKey"`
+	TotpSecretKey string `json:"totpSecretKey"`
+	ApiKeyKey     string `json:"apiKeyKey"`
 }
 
 // heProviderConfig is a structure that is used to decode into when
@@ -79,6 +131,33 @@ type heProviderConfig struct {
 	ApiKeySecretRef      secretRef `json:"ApiKeySecretRef"`
 	HeUrl                string    `json:"heUrl"`
 	Method               string    `json:"method"`
+
+	// where to get the credentials from: "env", "secret", "file" or "exec".
+	// If empty, the deployment-wide default is used
+	CredentialProvider string     `json:"credentialProvider"`
+	Exec               execConfig `json:"exec"`
+
+	// optional per-zone accounts, when a single issuer covers zones managed
+	// by different HE accounts
+	Accounts []heAccount `json:"accounts"`
+
+	// methods to try, in order, when login mode fails because the HE pages
+	// cannot be parsed
+	Fallback []fallbackConfig `json:"fallback"`
+
+	// wait in Present until the record is served by all the HE nameservers;
+	// if not set, the webhook-wide setting is used
+	WaitForPropagation *bool `json:"waitForPropagation"`
+}
+
+// how often to check the nameservers when waiting for propagation
+const propagationPollInterval = 5 * time.Second
+
+func (cfg heProviderConfig) waitForPropagation(settings *webhookConfig) bool {
+	if cfg.WaitForPropagation != nil {
+		return *cfg.WaitForPropagation
+	}
+	return settings.WaitForPropagation
 }
 
 // Name is used as the name for this DNS solver when referencing it on the ACME
@@ -96,46 +175,105 @@ func (c *heProviderSolver) Name() string {
 // This method should tolerate being called multiple times with the same value.
 // cert-manager itself will later perform a self check to ensure that the
 // solver has correctly configured the DNS provider.
-func (c *heProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
-
-	hc, err := c.initConfig(ch)
+func (c *heProviderSolver) Present(ch *v1alpha1.ChallengeRequest) (err error) {
+
+	method := ""
+	done := observeOperation("present", ch)
+	ctx, span := startChallengeSpan(challengeContext(ch), "present", ch)
+	logger := klog.FromContext(ctx)
+	defer func() {
+		done(method, err)
+		endChallengeSpan(span, method, err)
+		c.events.outcome(ch, "present", method, err)
+	}()
+
+	hc, cfg, err := c.initConfig(ctx, ch)
 	if err != nil {
 		return err
 	}
+	method = hc.Method
+
+	if err := c.checkDelegation(ctx, ch); err != nil {
+		logger.Error(err, "Error during Present")
+		return err
+	}
 
 	if hc.Method == "login" {
-		err = hc.AddTxtRecordWithLogin(ch)
+		err = hc.AddTxtRecordWithLogin(ctx, ch)
+		if utils.IsLayoutError(err) && len(cfg.Fallback) > 0 {
+			method, err = c.presentWithFallback(ctx, cfg, ch, err)
+		}
 	} else {
-		err = hc.AddTxtRecordWithDynamicDns(ch)
+		err = c.presentDynamicDns(ctx, hc, ch)
+	}
+
+	if err == nil && cfg.waitForPropagation(c.config.Get()) {
+		err = c.waitForPropagation(ctx, ch)
 	}
 
 	if err != nil {
-		klog.ErrorS(err, "Error during Present")
+		logger.Error(err, "Error during Present")
 	}
 	return err
 }
 
+// waitForPropagation waits until the HE nameservers serve the challenge
+// record, so that cert-manager's self check doesn't hit one that hasn't
+// got it yet
+func (c *heProviderSolver) waitForPropagation(ctx context.Context, ch *v1alpha1.ChallengeRequest) error {
+	settings := c.config.Get()
+	if len(settings.Nameservers) == 0 {
+		klog.FromContext(ctx).Info("Not waiting for propagation, no nameservers are configured")
+		return nil
+	}
+	return utils.WaitForTxt(ctx, settings.Nameservers, ch.ResolvedFQDN, ch.Key, settings.PropagationTimeout.Duration, propagationPollInterval)
+}
+
 // CleanUp  should delete the relevant TXT record from the DNS provider console.
 // If multiple TXT records exist with the same record name (e.g.
 // _acme-challenge.example.com) then **only** the record with the same `key`
 // value provided on the ChallengeRequest should be cleaned up.
 // This is in order to facilitate multiple DNS validations for the same domain
 // concurrently.
-func (c *heProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
-
-	hc, err := c.initConfig(ch)
+func (c *heProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) (err error) {
+
+	method := ""
+	done := observeOperation("cleanup", ch)
+	ctx, span := startChallengeSpan(challengeContext(ch), "cleanup", ch)
+	logger := klog.FromContext(ctx)
+	defer func() {
+		done(method, err)
+		endChallengeSpan(span, method, err)
+		c.events.outcome(ch, "cleanup", method, err)
+	}()
+
+	hc, cfg, err := c.initConfig(ctx, ch)
 	if err != nil {
 		return err
 	}
+	method = hc.Method
 
 	if hc.Method == "login" {
-		err = hc.RemoveTxtRecordWithLogin(ch)
+		if i, ok := c.fallbacks.take(ch); ok && i < len(cfg.Fallback) {
+			method, err = c.cleanUpWithFallback(ctx, cfg, i, ch)
+		} else {
+			err = hc.RemoveTxtRecordWithLogin(ctx, ch)
+			// the record may have been presented through a fallback before a restart
+			if utils.IsLayoutError(err) && len(cfg.Fallback) > 0 {
+				for i := range cfg.Fallback {
+					if m, fbErr := c.cleanUpWithFallback(ctx, cfg, i, ch); fbErr == nil {
+						method, err = m, nil
+						break
+					}
+				}
+			}
+		}
 	} else {
-		err = hc.RemoveTxtRecordWithDynamicDns(ch)
+		err = c.cleanUpDynamicDns(ctx, hc, ch)
 	}
 
 	if err != nil {
-		klog.ErrorS(err, "Error during CleanUp")
+		logger.Error(err, "Error during CleanUp")
 	}
 	return err
 }
@@ -159,13 +297,37 @@ func (c *heProviderSolver) Initialize(kubeClientConfig *rest.Config, stopCh <-ch
 	}
 
 	c.client = cl
+	c.secrets = newSecretCache(cl, stopCh)
+	c.secrets.onUpdate = func(namespace, name string) {
+		c.ddnsCooldowns.clear(secretIdentity(namespace, name))
+	}
+
+	if c.events, err = newEventRecorder(kubeClientConfig, cl, stopCh); err != nil {
+		klog.ErrorS(err, "Cannot record events, going on without them")
+	}
+
+	if err := c.config.Watch(stopCh); err != nil {
+		return err
+	}
+
+	c.files = newFileCredentialsFromEnv()
+	if c.files != nil {
+		if err := c.files.Watch(stopCh); err != nil {
+			return err
+		}
+	}
+
+	c.startKeyRotation(stopCh)
 	///// END OF CODE TO MAKE KUBERNETES CLIENTSET AVAILABLE
 	return nil
 }
 
 // loadConfig is a small helper function that decodes JSON configuration into
 // the typed config struct.
-func loadConfig(cfgJSON *extapi.JSON) (heProviderConfig, error) {
+// Unknown fields and inconsistent settings are rejected (all the problems
+// reported together), so that typos don't go unnoticed and silently fall back
+// to the defaults. defaultMethod is the method used if the config has none.
+func loadConfig(cfgJSON *extapi.JSON, defaultMethod string) (heProviderConfig, error) {
 	cfg := heProviderConfig{}
 	// handle the 'base case' where no configuration has been provided
 	if cfgJSON == nil {
@@ -175,155 +337,180 @@ func loadConfig(cfgJSON *extapi.JSON) (heProviderConfig, error) {
 		return cfg, fmt.Errorf("error decoding solver config: %v", err)
 	}
 
+	problems := configProblems{}
+	checkFields(cfgJSON.Raw, reflect.TypeOf(cfg), "", &problems)
+	cfg.check(defaultMethod, &problems)
+	if err := problems.err(); err != nil {
+		return cfg, err
+	}
+
 	return cfg, nil
 }
 
-func (c *heProviderSolver) initConfig(ch *v1alpha1.ChallengeRequest) (*utils.HeClient, error) {
+func (c *heProviderSolver) initConfig(ctx context.Context, ch *v1alpha1.ChallengeRequest) (_ *utils.HeClient, _ heProviderConfig, err error) {
+
+	ctx, span := tracer.Start(ctx, "initConfig")
+	defer func() { endSpan(span, err) }()
 
-	cfg, err := loadConfig(ch.Config)
+	settings := c.config.Get()
+
+	cfg, err := loadConfig(ch.Config, settings.Method)
 	if err != nil {
-		return nil, err
+		return nil, cfg, err
 	}
 
-	if cfg.Method != "" && cfg.Method != "login" && cfg.Method != "dynamic-dns" {
-		return nil, fmt.Errorf("invalid configuration method '%v', valid values are 'login' or 'dynamic-dns'", cfg.Method)
+	if len(cfg.Accounts) > 0 {
+		account, err := selectAccount(cfg.Accounts, ch.ResolvedZone)
+		if err != nil {
+			return nil, cfg, err
+		}
+		klog.FromContext(ctx).V(2).Info("Selected account", "zone", ch.ResolvedZone, "zones", account.Zones)
+		cfg = cfg.withAccount(account)
 	}
 
-	// fill in config defaults
-	if cfg.Method == "" {
-		cfg.Method = "login"
+	if err := settings.checkCredentialProvider(cfg.CredentialProvider, ch.ResourceNamespace); err != nil {
+		return nil, cfg, err
 	}
 
-	if cfg.Method == "login" {
-		if cfg.HeUrl == "" {
-			cfg.HeUrl = "https://dns.he.net/"
-		}
-	} else {
-		if cfg.HeUrl == "" {
-			cfg.HeUrl = "https://dyn.dns.he.net/"
-		}
-	}
-	// add trailing slash to heUrl if not present
-	if cfg.HeUrl[len(cfg.HeUrl)-1:] != "/" {
-		cfg.HeUrl += "/"
+	return c.newClient(ctx, cfg, settings, ch)
+}
+
+// newClient builds the HE client for a solver config, with the account
+// already selected. It also returns the config with the defaults filled in.
+func (c *heProviderSolver) newClient(ctx context.Context, cfg heProviderConfig, settings *webhookConfig, ch *v1alpha1.ChallengeRequest) (*utils.HeClient, heProviderConfig, error) {
+
+	cfg, err := resolveConfig(cfg, settings, ch.ResourceNamespace)
+	if err != nil {
+		return nil, cfg, err
 	}
 
-	heClient := &utils.HeClient{
-		Method: cfg.Method,
-		HeUrl:  cfg.HeUrl,
+	provider, err := c.credentialProvider(cfg)
+	if err != nil {
+		return nil, cfg, err
 	}
+	// taken before auto sets the method, since with auto the credentials are
+	// read from the only reference given, whatever the method chosen
+	identity := credentialIdentity(provider, cfg, ch)
 
-	useSecrets := os.Getenv("USE_SECRETS")
+	creds, err := fetchCredentials(ctx, provider, cfg, ch)
+	if err != nil {
+		return nil, cfg, err
+	}
 
-	if useSecrets == "true" {
-		err = c.populateClientFromSecrets(heClient, cfg, ch)
-	} else {
-		err = c.populateClientFromEnv(heClient, cfg, ch)
+	if cfg.Method == "auto" {
+		if cfg.Method, err = chooseMethod(creds); err != nil {
+			return nil, cfg, err
+		}
+		klog.FromContext(ctx).Info("Selected method automatically", "method", cfg.Method, "zone", ch.ResolvedZone, "fqdn", ch.ResolvedFQDN)
+		if err := cfg.resolveHeUrl(settings); err != nil {
+			return nil, cfg, err
+		}
 	}
 
-	if err != nil {
-		return nil, err
+	heClient := &utils.HeClient{
+		Method:      cfg.Method,
+		HeUrl:       cfg.HeUrl,
+		TTL:         settings.TTL,
+		Nameservers: settings.Nameservers,
+		Placeholder: settings.DynamicDnsPlaceholder,
+	}
+	heClient.Username = creds.Username
+	heClient.Password = creds.Password
+	heClient.TotpSecret = creds.TotpSecret
+	heClient.ApiKey = creds.ApiKey
+	heClient.Audit = c.audit.get(settings.AuditLog)
+	heClient.AuditSubject = utils.AuditSubject{
+		Challenge:   challengeTag(ch),
+		Namespace:   ch.ResourceNamespace,
+		Credentials: identity,
 	}
 
 	jar, err := cookiejar.New(nil)
 	if err != nil {
-		return nil, fmt.Errorf("error creating cookie jar: %v", err)
+		return nil, cfg, fmt.Errorf("error creating cookie jar: %v", err)
 	}
 
-	client := &http.Client{
-		Jar: jar,
+	heClient.Client = utils.NewHttpClient(settings.Timeout.Duration, jar)
+	if c.snapshots != nil {
+		// also drops the snapshots if they have been disabled
+		c.snapshots.SetLimit(settings.DebugSnapshots)
+		if settings.DebugSnapshots > 0 {
+			heClient.Snapshots = c.snapshots
+		}
 	}
-	heClient.Client = client
-	klog.V(4).InfoS("Generated config", "heClient", heClient)
+	klog.FromContext(ctx).V(4).Info("Generated config", "heClient", heClient)
 
-	return heClient, nil
+	return heClient, cfg, nil
 }
 
-func (c *heProviderSolver) populateClientFromSecrets(heClient *utils.HeClient, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+// resolveConfig fills in the defaults of a solver config (with the account,
+// if any, already selected), and checks it against the webhook-wide policy:
+// the heUrl allowlist, and the secrets the webhook may read. namespace is
+// the one secrets are looked for in when the reference doesn't specify it;
+// if empty, only the secret names are checked.
+func resolveConfig(cfg heProviderConfig, settings *webhookConfig, namespace string) (heProviderConfig, error) {
 
-	secretData := map[string]*map[string][]byte{}
-	secretNamespaces := map[string]string{}
+	// fill in config defaults
+	if cfg.Method == "" {
+		cfg.Method = settings.Method
+	}
 
-	if cfg.Method == "login" {
-		if cfg.CredentialsSecretRef.Name == "" {
-			cfg.CredentialsSecretRef.Name = "he-credentials"
-		}
-		secretData[cfg.CredentialsSecretRef.Name] = &map[string][]byte{}
-		if cfg.CredentialsSecretRef.Namespace != "" {
-			secretNamespaces[cfg.CredentialsSecretRef.Name] = cfg.CredentialsSecretRef.Namespace
-		} else {
-			secretNamespaces[cfg.CredentialsSecretRef.Name] = ch.ResourceNamespace
-		}
-	} else {
-		if cfg.ApiKeySecretRef.Name == "" {
-			cfg.ApiKeySecretRef.Name = "he-credentials"
-		}
-		secretData[cfg.ApiKeySecretRef.Name] = &map[string][]byte{}
-		if cfg.ApiKeySecretRef.Namespace != "" {
-			secretNamespaces[cfg.ApiKeySecretRef.Name] = cfg.ApiKeySecretRef.Namespace
-		} else {
-			secretNamespaces[cfg.ApiKeySecretRef.Name] = ch.ResourceNamespace
+	// with auto, the default heUrl is only known once the method is chosen
+	if cfg.Method != "auto" || cfg.HeUrl != "" {
+		if err := cfg.resolveHeUrl(settings); err != nil {
+			return cfg, err
 		}
 	}
 
-	// read the secret(s)
-	for secretName := range secretData {
+	// auto takes the only secret reference given, whichever it is
+	if cfg.Method == "auto" && cfg.CredentialsSecretRef.Name == "" {
+		cfg.CredentialsSecretRef = cfg.ApiKeySecretRef
+	}
 
-		sec, err := c.client.CoreV1().Secrets(secretNamespaces[secretName]).Get(context.TODO(), secretName, metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("unable to read secret `%s/%s`: %v", secretNamespaces[secretName], secretName, err)
-		}
-		secretData[secretName] = &sec.Data
+	if cfg.CredentialsSecretRef.Name == "" {
+		cfg.CredentialsSecretRef.Name = settings.SecretName
+	}
+	if cfg.ApiKeySecretRef.Name == "" {
+		cfg.ApiKeySecretRef.Name = settings.SecretName
+	}
+	if cfg.CredentialProvider == "" {
+		cfg.CredentialProvider = settings.CredentialProvider
 	}
 
-	if cfg.Method == "login" {
-		usernameKey := "username"
-		passwordKey := "password"
-		username, err := getKeyFromSecret(secretData[cfg.CredentialsSecretRef.Name], usernameKey)
-		if err != nil {
-			return fmt.Errorf("unable to get %v from secret `%s/%s`; %v", usernameKey, ch.ResourceNamespace, cfg.CredentialsSecretRef.Name, err)
+	if cfg.CredentialProvider == "secret" {
+		ref := cfg.ApiKeySecretRef
+		if cfg.Method != "dynamic-dns" {
+			ref = cfg.CredentialsSecretRef
 		}
-		heClient.Username = username
-
-		password, err := getKeyFromSecret(secretData[cfg.CredentialsSecretRef.Name], passwordKey)
-		if err != nil {
-			return fmt.Errorf("unable to get %v from secret `%s/%s`; %v", passwordKey, ch.ResourceNamespace, cfg.CredentialsSecretRef.Name, err)
+		if ref.Namespace != "" {
+			namespace = ref.Namespace
 		}
-		heClient.Password = password
-	} else {
-		// extract credentials
-		apiKeyKey := "apiKey"
-
-		apiKey, err := getKeyFromSecret(secretData[cfg.ApiKeySecretRef.Name], apiKeyKey)
-		if err != nil {
-			return fmt.Errorf("unable to get %v from secret `%s/%s`; %v", apiKeyKey, ch.ResourceNamespace, cfg.ApiKeySecretRef.Name, err)
+		if err := newSecretPolicyFromEnv().check(namespace, ref.Name); err != nil {
+			return cfg, err
 		}
-		heClient.ApiKey = apiKey
 	}
-	return nil
+
+	return cfg, nil
 }
 
-func (c *heProviderSolver) populateClientFromEnv(heClient *utils.HeClient, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) error {
+// resolveHeUrl sets the default heUrl for the method if none was given, and
+// checks it against the allowlist
+func (cfg *heProviderConfig) resolveHeUrl(settings *webhookConfig) error {
+
 	if cfg.Method == "login" {
-		heClient.Username = os.Getenv("HE_USERNAME")
-		heClient.Password = os.Getenv("HE_PASSWORD")
+		if cfg.HeUrl == "" {
+			cfg.HeUrl = settings.LoginUrl
+		}
 	} else {
-		heClient.ApiKey = os.Getenv("HE_APIKEY")
+		if cfg.HeUrl == "" {
+			cfg.HeUrl = settings.DynamicDnsUrl
+		}
 	}
-	return nil
-}
-
-// extract a key from a secret
-func getKeyFromSecret(secretData *map[string][]byte, key string) (string, error) {
-
-	data, ok := (*secretData)[key]
+	// add trailing slash to heUrl if not present
+	cfg.HeUrl = withTrailingSlash(cfg.HeUrl)
 
-	if !ok {
-		return "", fmt.Errorf("key %q not found in secret data", key)
-	}
-	d := string(data)
-	if d == "" {
-		return "", fmt.Errorf("value for key %q is empty", key)
+	if !settings.endpointAllowed(cfg.HeUrl) {
+		return fmt.Errorf("heUrl '%v' is not among the allowed endpoints %v", cfg.HeUrl, settings.AllowedEndpoints)
 	}
-	return d, nil
+	return nil
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"k8s.io/klog/v2"
 
 	acmetest "github.com/cert-manager/cert-manager/test/acme"
@@ -46,3 +48,129 @@ func TestRunsSuiteLogin(t *testing.T) {
 	fixture.RunExtended(t)
 
 }
+
+func TestResolveConfigAuto(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	settings := defaultWebhookConfig()
+	settings.CredentialProvider = "secret"
+
+	tests := []struct {
+		name string
+		cfg  heProviderConfig
+		// the reference auto reads the credentials from
+		wantRef secretRef
+		wantUrl string
+	}{
+		{
+			name:    "credentials reference",
+			cfg:     heProviderConfig{Method: "auto", CredentialsSecretRef: secretRef{Name: "he"}},
+			wantRef: secretRef{Name: "he"},
+		},
+		{
+			name:    "api key reference",
+			cfg:     heProviderConfig{Method: "auto", ApiKeySecretRef: secretRef{Name: "ddns", ApiKeyKey: "key"}},
+			wantRef: secretRef{Name: "ddns", ApiKeyKey: "key"},
+		},
+		{
+			name:    "default secret",
+			cfg:     heProviderConfig{Method: "auto"},
+			wantRef: secretRef{Name: "he-credentials"},
+		},
+		{
+			name:    "explicit heUrl",
+			cfg:     heProviderConfig{Method: "auto", HeUrl: "https://he.example"},
+			wantRef: secretRef{Name: "he-credentials"},
+			wantUrl: "https://he.example/",
+		},
+	}
+	for _, tt := range tests {
+		cfg, err := resolveConfig(tt.cfg, settings, "certs")
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if ref, _ := credentialSecret(cfg, &v1alpha1.ChallengeRequest{}); ref != tt.wantRef {
+			t.Errorf("%v: got reference %+v, want %+v", tt.name, ref, tt.wantRef)
+		}
+		// with auto, the default heUrl depends on the method chosen later
+		if cfg.HeUrl != tt.wantUrl {
+			t.Errorf("%v: got heUrl %q, want %q", tt.name, cfg.HeUrl, tt.wantUrl)
+		}
+	}
+}
+
+func TestNewClientAuto(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	settings := defaultWebhookConfig()
+	settings.CredentialProvider = "env"
+	c := &heProviderSolver{}
+	ch := &v1alpha1.ChallengeRequest{ResourceNamespace: "certs", ResolvedZone: "example.com."}
+
+	tests := []struct {
+		name       string
+		env        map[string]string
+		wantMethod string
+		wantUrl    string
+	}{
+		{
+			name:       "login",
+			env:        map[string]string{"HE_USERNAME": "user", "HE_PASSWORD": "pass", "HE_APIKEY": "key"},
+			wantMethod: "login",
+			wantUrl:    "https://dns.he.net/",
+		},
+		{
+			name:       "dynamic-dns",
+			env:        map[string]string{"HE_USERNAME": "user", "HE_APIKEY": "key"},
+			wantMethod: "dynamic-dns",
+			wantUrl:    "https://dyn.dns.he.net/",
+		},
+		{
+			name: "nothing",
+			env:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{"HE_USERNAME", "HE_PASSWORD", "HE_TOTP_SECRET", "HE_APIKEY"} {
+			t.Setenv(name, tt.env[name])
+		}
+		hc, cfg, err := c.newClient(context.Background(), heProviderConfig{Method: "auto"}, settings, ch)
+		if tt.wantMethod == "" {
+			if err == nil {
+				t.Errorf("%v: got method %v, want an error", tt.name, hc.Method)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if hc.Method != tt.wantMethod || cfg.Method != tt.wantMethod || hc.HeUrl != tt.wantUrl {
+			t.Errorf("%v: got method %v (config %v) and heUrl %v, want %v and %v", tt.name, hc.Method, cfg.Method, hc.HeUrl, tt.wantMethod, tt.wantUrl)
+		}
+	}
+}
+
+func TestNewClientAuditSubject(t *testing.T) {
+	t.Setenv("GROUP_NAME", "acme.example.com")
+	settings := defaultWebhookConfig()
+	settings.CredentialProvider = "secret"
+	secrets, _, _ := newSecretTestCache(t)
+	c := &heProviderSolver{secrets: secrets}
+	ch := testChallengeRequest()
+
+	// auto reads the secret holding only an API key from credentialsSecretRef,
+	// and chooses dynamic-dns
+	hc, cfg, err := c.newClient(context.Background(), heProviderConfig{Method: "auto", CredentialsSecretRef: secretRef{Name: "he-key"}}, settings, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Method != "dynamic-dns" {
+		t.Fatalf("got method %v, want dynamic-dns", cfg.Method)
+	}
+	if hc.AuditSubject.Credentials != "secret:certs/he-key" {
+		t.Errorf("got credentials %q, want the secret that was read", hc.AuditSubject.Credentials)
+	}
+	if hc.AuditSubject.Challenge != challengeTag(ch) || hc.AuditSubject.Namespace != "certs" {
+		t.Errorf("unexpected audit subject %+v", hc.AuditSubject)
+	}
+}
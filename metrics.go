@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+var (
+	operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "he_webhook",
+		Name:      "operations_total",
+		Help:      "Present and CleanUp calls, by operation, method, zone and result.",
+	}, []string{"operation", "method", "zone", "result"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "he_webhook",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of the Present and CleanUp calls, by operation and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"operation", "method"})
+
+	operationsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "he_webhook",
+		Name:      "operations_in_flight",
+		Help:      "Present and CleanUp calls currently running, by operation.",
+	}, []string{"operation"})
+)
+
+// startMetricsServer serves the Prometheus metrics over plain HTTP on
+// METRICS_ADDR (eg, ":9402"), if set
+func startMetricsServer() {
+
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		operations, operationDuration, operationsInFlight,
+	)
+	utils.RegisterMetrics(registry)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		klog.InfoS("Starting metrics server", "addr", addr)
+		if err := server.ListenAndServe(); err != nil {
+			klog.ErrorS(err, "Metrics server stopped")
+			os.Exit(1)
+		}
+	}()
+}
+
+// startDebugServer serves the snapshots of unexpected HE pages over plain
+// HTTP on DEBUG_ADDR (eg, "127.0.0.1:9403"), if set. They show the zones and
+// records of the account, so only loopback addresses are accepted: the pages
+// are reached with kubectl port-forward.
+func startDebugServer(snapshots *utils.SnapshotStore) {
+
+	addr := os.Getenv("DEBUG_ADDR")
+	if addr == "" {
+		return
+	}
+	if err := checkLoopbackAddr(addr); err != nil {
+		klog.ErrorS(err, "Cannot start the debug server", "addr", addr)
+		os.Exit(1)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/snapshots", snapshots)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		klog.InfoS("Starting debug server", "addr", addr)
+		if err := server.ListenAndServe(); err != nil {
+			klog.ErrorS(err, "Debug server stopped")
+			os.Exit(1)
+		}
+	}()
+}
+
+// checkLoopbackAddr checks that addr only listens on a loopback interface
+func checkLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("the address must be a loopback one, eg 127.0.0.1:9403")
+	}
+	return nil
+}
+
+// observeOperation starts measuring a Present or CleanUp call; the returned
+// function records its outcome
+func observeOperation(operation string, ch *v1alpha1.ChallengeRequest) func(method string, err error) {
+	start := time.Now()
+	operationsInFlight.WithLabelValues(operation).Inc()
+
+	return func(method string, err error) {
+		operationsInFlight.WithLabelValues(operation).Dec()
+		if method == "" {
+			method = "unknown"
+		}
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		zone := strings.TrimSuffix(ch.ResolvedZone, ".")
+		operations.WithLabelValues(operation, method, zone, result).Inc()
+		operationDuration.WithLabelValues(operation, method).Observe(time.Since(start).Seconds())
+	}
+}
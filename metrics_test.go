@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestCheckLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: "127.0.0.1:9403"},
+		{addr: "[::1]:9403"},
+		{addr: "localhost:9403"},
+		{addr: ":9403", wantErr: true},
+		{addr: "0.0.0.0:9403", wantErr: true},
+		{addr: "10.0.0.1:9403", wantErr: true},
+		{addr: "127.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkLoopbackAddr(tt.addr); tt.wantErr != (err != nil) {
+			t.Errorf("%v: got %v, want an error: %v", tt.addr, err, tt.wantErr)
+		}
+	}
+}
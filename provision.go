@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http/cookiejar"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+// names collects the values of a repeatable flag
+type names []string
+
+func (n *names) String() string {
+	return strings.Join(*n, ",")
+}
+
+func (n *names) Set(value string) error {
+	*n = append(*n, value)
+	return nil
+}
+
+// runProvision implements the `provision-ddns` command, which prepares
+// records for the dynamic-dns method using the login credentials (from the
+// environment or the HE_*_FILE files, like the webhook): it creates the TXT
+// records with dynamic DNS enabled, sets their DDNS key (the same one for all
+// of them, so a single secret can be used) and stores the key in a
+// Kubernetes secret, or prints it if no secret is given.
+func runProvision(args []string) error {
+
+	flags := flag.NewFlagSet("provision-ddns", flag.ExitOnError)
+	zone := flags.String("zone", "", "zone the records belong to (required)")
+	var records names
+	flags.Var(&records, "name", "name of a TXT record to provision, can be repeated (default _acme-challenge.<zone>)")
+	key := flags.String("key", "", "DDNS key to set (default: generate a random one)")
+	heUrl := flags.String("he-url", defaultWebhookConfig().LoginUrl, "URL of the HE control panel")
+	secretName := flags.String("secret-name", "", "name of the secret to store the key in (default: print the key)")
+	secretNamespace := flags.String("secret-namespace", "default", "namespace of the secret")
+	secretKey := flags.String("secret-key", "apiKey", "key of the secret data to store the key in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *zone == "" {
+		return fmt.Errorf("-zone must be given")
+	}
+	if len(records) == 0 {
+		records = names{"_acme-challenge." + strings.TrimSuffix(*zone, ".")}
+	}
+
+	provider, err := (&heProviderSolver{files: newFileCredentialsFromEnv()}).credentialProvider(heProviderConfig{})
+	if err != nil {
+		return err
+	}
+	creds, err := provider.Credentials(context.Background(), heProviderConfig{Method: "login"}, &v1alpha1.ChallengeRequest{})
+	if err != nil {
+		return err
+	}
+
+	if *key == "" {
+		if *key, err = utils.GenerateDynamicDnsKey(); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range records {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return fmt.Errorf("error creating cookie jar: %v", err)
+		}
+		hc := &utils.HeClient{
+			Username:   creds.Username,
+			Password:   creds.Password,
+			TotpSecret: creds.TotpSecret,
+			HeUrl:      withTrailingSlash(*heUrl),
+			Method:     "login",
+			Client:     utils.NewHttpClient(defaultWebhookConfig().Timeout.Duration, jar),
+		}
+		if _, err := hc.ProvisionDynamicDns(context.Background(), name, *zone, *key); err != nil {
+			return fmt.Errorf("cannot provision %v: %v", name, err)
+		}
+	}
+
+	if *secretName == "" {
+		fmt.Println(*key)
+		return nil
+	}
+
+	kubeConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return fmt.Errorf("cannot load kubernetes config: %v", err)
+	}
+	cl, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("error running NewForConfig: %+v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := writeSecretKey(ctx, cl, *secretNamespace, *secretName, *secretKey, *key, nil); err != nil {
+		return err
+	}
+	klog.InfoS("Stored DDNS key", "secret", *secretNamespace+"/"+*secretName, "key", *secretKey)
+	return nil
+}
+
+// writeSecretKey sets a key in the data of a secret (and the given
+// annotations, removing the ones with an empty value), creating the secret if
+// it doesn't exist and keeping the rest of its data otherwise. Updates are done on the latest version of the
+// secret, retrying on conflicts, so concurrent changes are not lost.
+func writeSecretKey(ctx context.Context, cl kubernetes.Interface, namespace, name, key, value string, annotations map[string]string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		sec, err := cl.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			sec = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: map[string]string{}},
+				Type:       corev1.SecretTypeOpaque,
+				Data:       map[string][]byte{key: []byte(value)},
+			}
+			for k, v := range annotations {
+				if v != "" {
+					sec.Annotations[k] = v
+				}
+			}
+			_, err = cl.CoreV1().Secrets(namespace).Create(ctx, sec, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// created in the meantime, retry as an update
+				return apierrors.NewConflict(corev1.Resource("secrets"), name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read secret %v/%v: %v", namespace, name, err)
+		}
+		if sec.Data == nil {
+			sec.Data = map[string][]byte{}
+		}
+		sec.Data[key] = []byte(value)
+		for k, v := range annotations {
+			if sec.Annotations == nil {
+				sec.Annotations = map[string]string{}
+			}
+			if v == "" {
+				delete(sec.Annotations, k)
+			} else {
+				sec.Annotations[k] = v
+			}
+		}
+		_, err = cl.CoreV1().Secrets(namespace).Update(ctx, sec, metav1.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+// annotation recording when the key in a secret was last rotated
+const keyRotatedAtAnnotation = "cert-manager-webhook-he/key-rotated-at"
+
+// annotation claiming the rotation of the key in a secret for one replica of
+// the webhook, set before HE is touched
+const keyRotationClaimAnnotation = "cert-manager-webhook-he/key-rotation-claimed-at"
+
+// how long a claim keeps the other replicas from rotating the key; longer
+// than a rotation can take. A failed rotation is retried when it expires.
+const keyRotationClaimTimeout = 30 * time.Minute
+
+// how often to check whether a key is due for rotation
+const keyRotationCheckPeriod = 10 * time.Minute
+
+// the shortest rotation interval allowed, to avoid hammering HE
+const minKeyRotationInterval = time.Hour
+
+// keyRotationConfig configures the scheduled rotation of dynamic-dns keys
+type keyRotationConfig struct {
+	// how often to rotate the keys; zero (the default) disables rotation
+	Interval metav1.Duration `json:"interval"`
+	Keys     []rotatedKey    `json:"keys"`
+}
+
+// rotatedKey is a DDNS key, shared by one or more records, that is stored in
+// a secret referenced by dynamic-dns issuers
+type rotatedKey struct {
+	Zone string `json:"zone"`
+	// records using the key, by default _acme-challenge.<zone>
+	Names []string `json:"names"`
+	// the secret holding the key; name and namespace are required
+	SecretRef secretRef `json:"secretRef"`
+
+	// where to get the login credentials used to set the keys from, like
+	// in the solver config
+	CredentialsSecretRef secretRef  `json:"credentialsSecretRef"`
+	CredentialProvider   string     `json:"credentialProvider"`
+	Exec                 execConfig `json:"exec"`
+	HeUrl                string     `json:"heUrl"`
+	// the dynamic DNS endpoint the new key is checked against, by default
+	// the webhook's dynamicDnsUrl
+	DynamicDnsUrl string `json:"dynamicDnsUrl"`
+}
+
+func (k rotatedKey) names() []string {
+	if len(k.Names) == 0 {
+		return []string{"_acme-challenge." + strings.TrimSuffix(k.Zone, ".")}
+	}
+	return k.Names
+}
+
+// validate returns the problems in the rotation settings
+func (cfg *keyRotationConfig) validate() []error {
+	var errs []error
+
+	if cfg.Interval.Duration == 0 {
+		return nil
+	}
+	if cfg.Interval.Duration < minKeyRotationInterval {
+		errs = append(errs, fmt.Errorf("keyRotation.interval must be at least %v, got %v", minKeyRotationInterval, cfg.Interval.Duration))
+	}
+	if len(cfg.Keys) == 0 {
+		errs = append(errs, fmt.Errorf("keyRotation.keys cannot be empty when rotation is enabled"))
+	}
+	for i, k := range cfg.Keys {
+		problems := configProblems{}
+		path := fmt.Sprintf("keyRotation.keys[%d]", i)
+		if k.Zone == "" {
+			problems.add(joinPath(path, "zone"), "must be set")
+		}
+		if k.SecretRef.Name == "" || k.SecretRef.Namespace == "" {
+			problems.add(joinPath(path, "secretRef"), "name and namespace must be set")
+		}
+		if k.DynamicDnsUrl != "" {
+			if err := validateUrl(k.DynamicDnsUrl); err != nil {
+				problems.add(joinPath(path, "dynamicDnsUrl"), "%v", err)
+			}
+		}
+		validateSolverSettings("login", "login", k.HeUrl, k.CredentialsSecretRef, secretRef{}, k.CredentialProvider, k.Exec, path, &problems)
+		for _, p := range problems {
+			errs = append(errs, fmt.Errorf("%v", p))
+		}
+	}
+	return errs
+}
+
+// startKeyRotation rotates the configured keys when they're due, until stopCh
+// is closed. The settings are read at every check, so rotation can be
+// enabled or changed by reloading the config. Every replica of the webhook
+// runs the checks, but only the one that claims a key rotates it.
+func (c *heProviderSolver) startKeyRotation(stopCh <-chan struct{}) {
+	go wait.Until(c.rotateKeys, keyRotationCheckPeriod, stopCh)
+}
+
+func (c *heProviderSolver) rotateKeys() {
+	settings := c.config.Get()
+	if settings.KeyRotation.Interval.Duration == 0 {
+		return
+	}
+	for _, k := range settings.KeyRotation.Keys {
+		if err := c.rotateKeyIfDue(k, settings); err != nil {
+			klog.ErrorS(err, "Key rotation failed", "zone", k.Zone, "secret", k.SecretRef.Namespace+"/"+k.SecretRef.Name)
+		}
+	}
+}
+
+// rotateKeyIfDue sets a new key for all the records sharing k, if the
+// interval has passed since the last rotation. Each record is checked with
+// the new key by setting its current value again through dynamic DNS, and if
+// any of them fails the others are set back to the old key, so that the
+// records sharing the secret never end up with different keys.
+func (c *heProviderSolver) rotateKeyIfDue(k rotatedKey, settings *webhookConfig) (err error) {
+
+	// the HE requests have their own timeout, only the API calls use ctx
+	heCtx, span := tracer.Start(context.Background(), "rotateKey", trace.WithAttributes(attribute.String("dns.zone", k.Zone)))
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := context.WithTimeout(heCtx, time.Minute)
+	defer cancel()
+
+	namespace, name := k.SecretRef.Namespace, k.SecretRef.Name
+	if err := newSecretPolicyFromEnv().check(namespace, name); err != nil {
+		return err
+	}
+
+	sec, err := c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot read secret %v/%v: %v", namespace, name, err)
+	}
+	if rotatedAt, err := time.Parse(time.RFC3339, sec.Annotations[keyRotatedAtAnnotation]); err == nil {
+		if time.Since(rotatedAt) < settings.KeyRotation.Interval.Duration {
+			return nil
+		}
+	}
+
+	dataKey := keyOrDefault(k.SecretRef.ApiKeyKey, "apiKey")
+	oldKey := string(sec.Data[dataKey])
+
+	if claimed, err := claimKeyRotation(ctx, c.client, sec); err != nil || !claimed {
+		return err
+	}
+
+	newKey, err := utils.GenerateDynamicDnsKey()
+	if err != nil {
+		return err
+	}
+
+	hc, _, err := c.newClient(heCtx, heProviderConfig{
+		Method:               "login",
+		HeUrl:                k.HeUrl,
+		CredentialsSecretRef: k.CredentialsSecretRef,
+		CredentialProvider:   k.CredentialProvider,
+		Exec:                 k.Exec,
+	}, settings, &v1alpha1.ChallengeRequest{ResourceNamespace: namespace, ResolvedZone: k.Zone})
+	if err != nil {
+		return err
+	}
+
+	klog.InfoS("Rotating dynamic DNS key", "zone", k.Zone, "names", k.names(), "secret", namespace+"/"+name)
+
+	rotated := []string{}
+	for _, fqdn := range k.names() {
+		rotated = append(rotated, fqdn)
+		value, err := hc.RotateDynamicDnsKey(heCtx, fqdn, k.Zone, newKey)
+		if err == nil {
+			err = checkDynamicDnsKey(heCtx, k, fqdn, newKey, value, settings)
+		}
+		if err != nil {
+			restoreDynamicDnsKey(heCtx, hc, rotated, k.Zone, oldKey)
+			return fmt.Errorf("cannot rotate the key of %v: %v", fqdn, err)
+		}
+	}
+
+	annotations := map[string]string{
+		keyRotatedAtAnnotation: time.Now().UTC().Format(time.RFC3339),
+		// the claim is removed only on success, so that a failed rotation
+		// isn't retried by every replica right away
+		keyRotationClaimAnnotation: "",
+	}
+	if err := writeSecretKey(ctx, c.client, namespace, name, dataKey, newKey, annotations); err != nil {
+		// the new key would be lost, and the issuers left with a key HE
+		// doesn't accept: go back to the old one, and retry at the next check
+		restoreDynamicDnsKey(heCtx, hc, k.names(), k.Zone, oldKey)
+		releaseKeyRotationClaim(ctx, c.client, namespace, name)
+		return fmt.Errorf("cannot update secret %v/%v with the new key, the old one was set back: %v", namespace, name, err)
+	}
+
+	klog.InfoS("Rotated dynamic DNS key", "zone", k.Zone, "names", k.names(), "secret", namespace+"/"+name)
+	return nil
+}
+
+// claimKeyRotation marks the secret as being rotated by this replica. The
+// update is conditional on the version of the secret that was read, so when
+// several replicas find the key due at the same time only one of them gets to
+// set a new key at HE; the others (and the ones finding a recent claim) skip it.
+func claimKeyRotation(ctx context.Context, cl kubernetes.Interface, sec *corev1.Secret) (bool, error) {
+
+	if claimedAt, err := time.Parse(time.RFC3339, sec.Annotations[keyRotationClaimAnnotation]); err == nil {
+		if time.Since(claimedAt) < keyRotationClaimTimeout {
+			klog.V(2).InfoS("Key rotation claimed by another replica, or failed recently", "secret", sec.Namespace+"/"+sec.Name, "claimedAt", claimedAt)
+			return false, nil
+		}
+	}
+
+	claim := sec.DeepCopy()
+	if claim.Annotations == nil {
+		claim.Annotations = map[string]string{}
+	}
+	claim.Annotations[keyRotationClaimAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if _, err := cl.CoreV1().Secrets(sec.Namespace).Update(ctx, claim, metav1.UpdateOptions{}); err != nil {
+		if apierrors.IsConflict(err) {
+			klog.V(2).InfoS("Secret changed while claiming the key rotation, leaving it to another replica", "secret", sec.Namespace+"/"+sec.Name)
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot claim the key rotation of secret %v/%v: %v", sec.Namespace, sec.Name, err)
+	}
+	return true, nil
+}
+
+// releaseKeyRotationClaim removes the claim from the secret, so that the
+// rotation is retried at the next check. Failures are only logged: the claim
+// expires anyway.
+func releaseKeyRotationClaim(ctx context.Context, cl kubernetes.Interface, namespace, name string) {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		sec, err := cl.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if _, ok := sec.Annotations[keyRotationClaimAnnotation]; !ok {
+			return nil
+		}
+		delete(sec.Annotations, keyRotationClaimAnnotation)
+		_, err = cl.CoreV1().Secrets(namespace).Update(ctx, sec, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		klog.ErrorS(err, "Cannot release the key rotation claim, it will expire", "secret", namespace+"/"+name)
+	}
+}
+
+// checkDynamicDnsKey checks a new key by setting the record to the value it
+// already has
+func checkDynamicDnsKey(ctx context.Context, k rotatedKey, fqdn string, key string, value string, settings *webhookConfig) error {
+	heUrl := k.DynamicDnsUrl
+	if heUrl == "" {
+		heUrl = settings.DynamicDnsUrl
+	}
+	hc := &utils.HeClient{
+		ApiKey: key,
+		HeUrl:  withTrailingSlash(heUrl),
+		Method: "dynamic-dns",
+		Client: utils.NewHttpClient(settings.Timeout.Duration, nil),
+	}
+	if err := hc.UpdateDynamicDns(ctx, fqdn, value); err != nil {
+		return fmt.Errorf("the new key doesn't work: %v", err)
+	}
+	return nil
+}
+
+// restoreDynamicDnsKey sets the old key back after a failed rotation
+func restoreDynamicDnsKey(ctx context.Context, hc *utils.HeClient, names []string, zone string, oldKey string) {
+	if oldKey == "" {
+		klog.InfoS("Cannot restore the previous dynamic DNS key, it is not known", "names", names)
+		return
+	}
+	for _, fqdn := range names {
+		if _, err := hc.RotateDynamicDnsKey(ctx, fqdn, zone, oldKey); err != nil {
+			klog.ErrorS(err, "Cannot restore the previous dynamic DNS key", "fqdn", fqdn)
+		}
+	}
+}
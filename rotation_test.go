@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+	"github.com/waldner/cert-manager-webhook-he/utils/hetest"
+)
+
+// newVersionedClientset returns a fake clientset whose secret updates fail
+// with a conflict when the resourceVersion isn't the stored one, like the API
+// server's. The reactors run under the clientset's lock.
+func newVersionedClientset(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sec := action.(k8stesting.UpdateAction).GetObject().(*corev1.Secret)
+		stored, err := client.Tracker().Get(schema.GroupVersionResource{Version: "v1", Resource: "secrets"}, sec.Namespace, sec.Name)
+		if err != nil {
+			return false, nil, nil
+		}
+		rv := stored.(*corev1.Secret).ResourceVersion
+		if sec.ResourceVersion != rv {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, sec.Name, nil)
+		}
+		n, _ := strconv.Atoi(rv)
+		sec.ResourceVersion = strconv.Itoa(n + 1)
+		return false, nil, nil
+	})
+	return client
+}
+
+// rotationTest is a fake HE panel with a dynamic record whose key is in the
+// certs/ddns secret, and the settings to rotate it
+type rotationTest struct {
+	he       *hetest.Server
+	client   *fake.Clientset
+	settings *webhookConfig
+	key      rotatedKey
+}
+
+func newRotationTest(t *testing.T) *rotationTest {
+	he := hetest.NewServer(t, "user", "pass", "example.com")
+	jar, _ := cookiejar.New(nil)
+	login := &utils.HeClient{Username: "user", Password: "pass", HeUrl: he.URL + "/", Method: "login", Client: &http.Client{Jar: jar}}
+	if _, err := login.ProvisionDynamicDns(context.Background(), "_acme-challenge.example.com", "example.com", "old-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("HE_USERNAME", "user")
+	t.Setenv("HE_PASSWORD", "pass")
+	key := rotatedKey{
+		Zone:               "example.com",
+		SecretRef:          secretRef{Name: "ddns", Namespace: "certs"},
+		CredentialProvider: "env",
+		HeUrl:              he.URL,
+		DynamicDnsUrl:      he.URL,
+	}
+	settings := testConfigStore(t, func(c *webhookConfig) {
+		c.KeyRotation = keyRotationConfig{Interval: metav1.Duration{Duration: 24 * time.Hour}, Keys: []rotatedKey{key}}
+		// the default endpoint must not be used
+		c.DynamicDnsUrl = "http://127.0.0.1:1/"
+	}).Get()
+
+	return &rotationTest{
+		he: he,
+		client: newVersionedClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "certs", Name: "ddns", ResourceVersion: "1"},
+			Data:       map[string][]byte{"apiKey": []byte("old-key")},
+		}),
+		settings: settings,
+		key:      key,
+	}
+}
+
+func (r *rotationTest) secret(t *testing.T) *corev1.Secret {
+	t.Helper()
+	sec, err := r.client.CoreV1().Secrets("certs").Get(context.Background(), "ddns", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sec
+}
+
+func TestRotateKey(t *testing.T) {
+	r := newRotationTest(t)
+	c := &heProviderSolver{client: r.client}
+
+	if err := c.rotateKeyIfDue(r.key, r.settings); err != nil {
+		t.Fatal(err)
+	}
+	sec := r.secret(t)
+	newKey := string(sec.Data["apiKey"])
+	if newKey == "old-key" || newKey == "" {
+		t.Fatalf("the key in the secret was not rotated")
+	}
+	if got := r.he.DynamicDnsKey("_acme-challenge.example.com"); got != newKey {
+		t.Errorf("HE has key %q, the secret %q", got, newKey)
+	}
+	if _, err := time.Parse(time.RFC3339, sec.Annotations[keyRotatedAtAnnotation]); err != nil {
+		t.Errorf("rotation time not recorded: %v", sec.Annotations)
+	}
+	if _, ok := sec.Annotations[keyRotationClaimAnnotation]; ok {
+		t.Errorf("the claim was kept after a successful rotation")
+	}
+
+	// not due again before the interval
+	if err := c.rotateKeyIfDue(r.key, r.settings); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(r.secret(t).Data["apiKey"]); got != newKey {
+		t.Errorf("the key was rotated again before the interval")
+	}
+}
+
+func TestRotateKeyFailedCheck(t *testing.T) {
+	r := newRotationTest(t)
+	c := &heProviderSolver{client: r.client}
+	broken := newFakeDynamicDns(t, "")
+	broken.setAnswer("badauth")
+	r.key.DynamicDnsUrl = broken.URL
+
+	if err := c.rotateKeyIfDue(r.key, r.settings); err == nil {
+		t.Fatal("the rotation succeeded although the new key didn't work")
+	}
+	if broken.updateCount() == 0 {
+		t.Errorf("the new key was not checked on the configured dynamicDnsUrl")
+	}
+	if got := r.he.DynamicDnsKey("_acme-challenge.example.com"); got != "old-key" {
+		t.Errorf("HE has key %q after a failed rotation, want the old one back", got)
+	}
+	sec := r.secret(t)
+	if got := string(sec.Data["apiKey"]); got != "old-key" {
+		t.Errorf("the secret has key %q after a failed rotation", got)
+	}
+	if _, ok := sec.Annotations[keyRotationClaimAnnotation]; !ok {
+		t.Errorf("the claim was removed after a failed rotation")
+	}
+
+	// the claim holds off the retries until it expires
+	updates := broken.updateCount()
+	if err := c.rotateKeyIfDue(r.key, r.settings); err != nil {
+		t.Fatal(err)
+	}
+	if broken.updateCount() != updates {
+		t.Errorf("the rotation was retried while claimed")
+	}
+}
+
+func TestRotateKeyFailedSecretUpdate(t *testing.T) {
+	r := newRotationTest(t)
+	c := &heProviderSolver{client: r.client}
+	// the claim goes through, but not the update with the new key
+	r.client.PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		sec := action.(k8stesting.UpdateAction).GetObject().(*corev1.Secret)
+		if _, ok := sec.Annotations[keyRotatedAtAnnotation]; ok {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, sec.Name, errors.New("not allowed"))
+		}
+		return false, nil, nil
+	})
+
+	if err := c.rotateKeyIfDue(r.key, r.settings); err == nil {
+		t.Fatal("the rotation succeeded although the secret cannot be updated")
+	}
+	if got := r.he.DynamicDnsKey("_acme-challenge.example.com"); got != "old-key" {
+		t.Errorf("HE has key %q, want the old one, still in the secret", got)
+	}
+	sec := r.secret(t)
+	if got := string(sec.Data["apiKey"]); got != "old-key" {
+		t.Errorf("the secret has key %q", got)
+	}
+	if _, ok := sec.Annotations[keyRotationClaimAnnotation]; ok {
+		t.Errorf("the claim was kept, the rotation won't be retried until it expires")
+	}
+}
+
+func TestRotateKeyReplicas(t *testing.T) {
+	r := newRotationTest(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &heProviderSolver{client: r.client}
+			if err := c.rotateKeyIfDue(r.key, r.settings); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, want := r.he.DynamicDnsKey("_acme-challenge.example.com"), string(r.secret(t).Data["apiKey"]); got != want || got == "old-key" {
+		t.Errorf("HE has key %q, the secret %q", got, want)
+	}
+}
+
+func TestClaimKeyRotation(t *testing.T) {
+	r := newRotationTest(t)
+	ctx := context.Background()
+	sec := r.secret(t)
+
+	if claimed, err := claimKeyRotation(ctx, r.client, sec); err != nil || !claimed {
+		t.Fatalf("got %v, %v for the first claim", claimed, err)
+	}
+	// another replica that read the secret before the claim
+	if claimed, err := claimKeyRotation(ctx, r.client, sec); err != nil || claimed {
+		t.Errorf("got %v, %v for a claim with a stale secret", claimed, err)
+	}
+	// or after it
+	if claimed, err := claimKeyRotation(ctx, r.client, r.secret(t)); err != nil || claimed {
+		t.Errorf("got %v, %v for a claim of a claimed secret", claimed, err)
+	}
+
+	// expired claims can be taken over
+	expired := r.secret(t)
+	expired.Annotations[keyRotationClaimAnnotation] = time.Now().Add(-keyRotationClaimTimeout - time.Minute).UTC().Format(time.RFC3339)
+	if claimed, err := claimKeyRotation(ctx, r.client, expired); err != nil || !claimed {
+		t.Errorf("got %v, %v for an expired claim", claimed, err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// how long to wait for a newly started informer to fill its cache before
+	// falling back to a plain GET
+	secretSyncTimeout = 10 * time.Second
+	// how long to keep reading a secret that could not be watched with plain
+	// GETs, before trying to start its informer again
+	secretFallbackPeriod = 5 * time.Minute
+	// how long an informer is kept after the last read of its secret
+	secretIdleTimeout = time.Hour
+	// the most secrets watched at the same time; the others are read with
+	// plain GETs, so that issuers referencing many secrets cannot make the
+	// webhook open watches without limit
+	maxWatchedSecrets = 100
+)
+
+// secretCache serves credential Secrets from informers, instead of doing a
+// GET against the API server for every Present and CleanUp.
+// There is one informer per referenced secret, restricted to its namespace
+// and name with a field selector, since that's all the (resourceNames
+// restricted) RBAC created by the chart allows us to list and watch.
+// Informers are stopped when their secret hasn't been read for a while.
+type secretCache struct {
+	client kubernetes.Interface
+	stopCh <-chan struct{}
+
+	policy secretPolicy
+	// how long to wait for an informer to sync
+	syncTimeout time.Duration
+	// how long an unused informer is kept, and how many can run
+	idleTimeout time.Duration
+	maxWatched  int
+	// if set, called when a watched secret changes
+	onUpdate func(namespace, name string)
+
+	mu      sync.Mutex
+	watched map[types.NamespacedName]*watchedSecret
+	// the secrets that could not be watched, and until when they're read
+	// with plain GETs
+	unwatched map[types.NamespacedName]time.Time
+	starting  singleflight.Group
+}
+
+// watchedSecret is a running informer for a secret
+type watchedSecret struct {
+	lister   corev1listers.SecretNamespaceLister
+	stop     func()
+	lastUsed time.Time
+}
+
+// newSecretCache returns a secretCache whose informers run until stopCh is
+// closed, or until they're idle
+func newSecretCache(client kubernetes.Interface, stopCh <-chan struct{}) *secretCache {
+	s := &secretCache{
+		client:      client,
+		stopCh:      stopCh,
+		policy:      newSecretPolicyFromEnv(),
+		syncTimeout: secretSyncTimeout,
+		idleTimeout: secretIdleTimeout,
+		maxWatched:  maxWatchedSecrets,
+		watched:     map[types.NamespacedName]*watchedSecret{},
+		unwatched:   map[types.NamespacedName]time.Time{},
+	}
+	go wait.Until(s.stopIdleInformers, secretIdleTimeout/10, stopCh)
+	return s
+}
+
+// stopIdleInformers stops the informers of the secrets that haven't been read
+// for idleTimeout; they're started again on the next read
+func (s *secretCache) stopIdleInformers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, w := range s.watched {
+		if time.Since(w.lastUsed) > s.idleTimeout {
+			w.stop()
+			delete(s.watched, key)
+			klog.V(2).InfoS("Stopped watching unused secret", "namespace", key.Namespace, "name", key.Name)
+		}
+	}
+}
+
+// Get returns the named secret, starting an informer for it on first use
+func (s *secretCache) Get(namespace, name string) (*corev1.Secret, error) {
+
+	if err := s.policy.check(namespace, name); err != nil {
+		return nil, err
+	}
+
+	lister, err := s.lister(namespace, name)
+	if err != nil {
+		klog.V(4).InfoS("Reading secret directly", "namespace", namespace, "name", name, "reason", err)
+		return s.client.CoreV1().Secrets(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	return lister.Get(name)
+}
+
+func (s *secretCache) lister(namespace, name string) (corev1listers.SecretNamespaceLister, error) {
+
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+
+	s.mu.Lock()
+	w, ok := s.watched[key]
+	if ok {
+		w.lastUsed = time.Now()
+	}
+	until, unwatched := s.unwatched[key]
+	full := len(s.watched) >= s.maxWatched
+	s.mu.Unlock()
+
+	if ok {
+		return w.lister, nil
+	}
+	if unwatched && time.Now().Before(until) {
+		return nil, fmt.Errorf("cannot watch the secret, not trying again until %v", until.Format(time.RFC3339))
+	}
+	if full {
+		return nil, fmt.Errorf("already watching %v secrets", s.maxWatched)
+	}
+
+	// the informer is started and synced without holding s.mu, so that a
+	// secret that cannot be watched doesn't hold up the reads of the others;
+	// concurrent first reads of the same secret wait for the same informer
+	v, err, _ := s.starting.Do(key.String(), func() (interface{}, error) {
+		s.mu.Lock()
+		w, ok := s.watched[key]
+		s.mu.Unlock()
+		if ok {
+			return w.lister, nil
+		}
+
+		lister, stop, err := s.startInformer(namespace, name)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			s.unwatched[key] = time.Now().Add(secretFallbackPeriod)
+			klog.InfoS("Cannot watch secret, reading it directly for a while", "namespace", namespace, "name", name, "reason", err, "period", secretFallbackPeriod)
+			return nil, err
+		}
+		delete(s.unwatched, key)
+		s.watched[key] = &watchedSecret{lister: lister, stop: stop, lastUsed: time.Now()}
+		return lister, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(corev1listers.SecretNamespaceLister), nil
+}
+
+// startInformer starts an informer for the secret and waits for it to sync.
+// It returns a function stopping the informer.
+func (s *secretCache) startInformer(namespace, name string) (corev1listers.SecretNamespaceLister, func(), error) {
+
+	factory := informers.NewSharedInformerFactoryWithOptions(s.client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	secrets := factory.Core().V1().Secrets()
+	_, err := secrets.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSecret, newSecret := oldObj.(*corev1.Secret), newObj.(*corev1.Secret)
+			if oldSecret.ResourceVersion != newSecret.ResourceVersion {
+				klog.InfoS("Credential secret changed", "namespace", namespace, "name", name)
+				if s.onUpdate != nil {
+					s.onUpdate(namespace, name)
+				}
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			klog.InfoS("Credential secret deleted", "namespace", namespace, "name", name)
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// each informer gets its own stop channel, so that one that cannot sync
+	// (eg, because RBAC forbids watching that secret) or isn't used anymore
+	// can be shut down
+	stop := make(chan struct{})
+	var once sync.Once
+	closeStop := func() { once.Do(func() { close(stop) }) }
+	go func() {
+		select {
+		case <-s.stopCh:
+			closeStop()
+		case <-stop:
+		}
+	}()
+
+	factory.Start(stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.syncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), secrets.Informer().HasSynced) {
+		closeStop()
+		return nil, nil, fmt.Errorf("timed out waiting for the informer cache to sync")
+	}
+
+	return secrets.Lister().Secrets(namespace), closeStop, nil
+}
+
+// secretPolicy holds the namespaces and names of the secrets the webhook is
+// allowed to read (as set up by the chart's RBAC); empty lists mean any.
+type secretPolicy struct {
+	namespaces []string
+	names      []string
+}
+
+func newSecretPolicyFromEnv() secretPolicy {
+	return secretPolicy{
+		namespaces: splitList(os.Getenv("SECRET_NAMESPACES")),
+		names:      splitList(os.Getenv("SECRET_NAMES")),
+	}
+}
+
+// check returns an error if the secret cannot be read. An empty namespace
+// is not checked.
+func (p secretPolicy) check(namespace, name string) error {
+	if (namespace != "" && !allowed(p.namespaces, namespace)) || !allowed(p.names, name) {
+		return fmt.Errorf("secret `%s/%s` is not among the secrets the webhook is allowed to read (see rbac.secretNamespaces and rbac.secretNames)", namespace, name)
+	}
+	return nil
+}
+
+// split a comma-separated list, ignoring empty elements
+func splitList(s string) []string {
+	list := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+func allowed(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, e := range list {
+		if e == value {
+			return true
+		}
+	}
+	return false
+}
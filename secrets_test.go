@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+func credentialSecretObject(name, apiKey, resourceVersion string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "certs", Name: name, ResourceVersion: resourceVersion},
+		Data:       map[string][]byte{"apiKey": []byte(apiKey)},
+	}
+}
+
+// secretRequests counts the list and get requests for each secret, and
+// forbids listing the ones in forbidden
+type secretRequests struct {
+	mu    sync.Mutex
+	lists map[string]int
+	gets  map[string]int
+}
+
+func newSecretTestCache(t *testing.T, forbidden ...string) (*secretCache, *fake.Clientset, *secretRequests) {
+	client := fake.NewSimpleClientset(
+		credentialSecretObject("he-key", "key-1", "1"),
+		credentialSecretObject("unwatchable", "key-2", "1"),
+	)
+	requests := &secretRequests{lists: map[string]int{}, gets: map[string]int{}}
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name, _ := action.(k8stesting.ListAction).GetListRestrictions().Fields.RequiresExactMatch("metadata.name")
+		requests.mu.Lock()
+		requests.lists[name]++
+		requests.mu.Unlock()
+		for _, f := range forbidden {
+			if f == name {
+				return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, name, errors.New("not allowed"))
+			}
+		}
+		return false, nil, nil
+	})
+	client.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		requests.mu.Lock()
+		requests.gets[action.(k8stesting.GetAction).GetName()]++
+		requests.mu.Unlock()
+		return false, nil, nil
+	})
+
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	s := newSecretCache(client, stopCh)
+	s.syncTimeout = 500 * time.Millisecond
+	return s, client, requests
+}
+
+func (r *secretRequests) count(name string) (lists int, gets int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lists[name], r.gets[name]
+}
+
+func TestSecretCacheServesFromInformer(t *testing.T) {
+	s, client, requests := newSecretTestCache(t)
+	updated := make(chan string, 10)
+	s.onUpdate = func(namespace, name string) { updated <- namespace + "/" + name }
+
+	// concurrent first reads share one informer
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Get("certs", "he-key"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if lists, gets := requests.count("he-key"); lists != 1 || gets != 0 {
+		t.Errorf("got %v lists and %v gets of the secret, want 1 list and no get", lists, gets)
+	}
+
+	if _, err := client.CoreV1().Secrets("certs").Update(context.Background(), credentialSecretObject("he-key", "key-3", "2"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-updated:
+		if name != "certs/he-key" {
+			t.Errorf("onUpdate called for %v", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("onUpdate not called after the secret changed")
+	}
+	sec, err := s.Get("certs", "he-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sec.Data["apiKey"]) != "key-3" {
+		t.Errorf("got apiKey %q after the update, want key-3", sec.Data["apiKey"])
+	}
+}
+
+func TestSecretCacheFallsBackToGet(t *testing.T) {
+	s, _, requests := newSecretTestCache(t, "unwatchable")
+
+	// a secret that cannot be watched doesn't hold up the others
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.Get("certs", "unwatchable")
+		done <- err
+	}()
+	start := time.Now()
+	if _, err := s.Get("certs", "he-key"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= s.syncTimeout {
+		t.Errorf("reading a watchable secret took %v, it waited for the unwatchable one", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("the unwatchable secret wasn't read directly: %v", err)
+	}
+
+	// the failure is remembered: the next reads are plain GETs
+	listsBefore, _ := requests.count("unwatchable")
+	for i := 0; i < 3; i++ {
+		sec, err := s.Get("certs", "unwatchable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(sec.Data["apiKey"]) != "key-2" {
+			t.Errorf("got apiKey %q, want key-2", sec.Data["apiKey"])
+		}
+	}
+	lists, gets := requests.count("unwatchable")
+	if lists != listsBefore || gets != 4 {
+		t.Errorf("got %v more lists and %v gets, want no more list and 4 gets", lists-listsBefore, gets)
+	}
+
+	// and forgotten after a while
+	s.mu.Lock()
+	for key := range s.unwatched {
+		s.unwatched[key] = time.Now().Add(-time.Second)
+	}
+	s.mu.Unlock()
+	if _, err := s.Get("certs", "unwatchable"); err != nil {
+		t.Fatal(err)
+	}
+	if lists, _ := requests.count("unwatchable"); lists == listsBefore {
+		t.Errorf("the informer wasn't started again after the fallback period")
+	}
+}
+
+func TestSecretCacheStopsIdleInformers(t *testing.T) {
+	s, _, requests := newSecretTestCache(t)
+	if _, err := s.Get("certs", "he-key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// still in use
+	s.stopIdleInformers()
+	if _, err := s.Get("certs", "he-key"); err != nil {
+		t.Fatal(err)
+	}
+	if lists, _ := requests.count("he-key"); lists != 1 {
+		t.Errorf("got %v lists, the informer of a used secret was stopped", lists)
+	}
+
+	s.mu.Lock()
+	s.watched[types.NamespacedName{Namespace: "certs", Name: "he-key"}].lastUsed = time.Now().Add(-s.idleTimeout - time.Minute)
+	s.mu.Unlock()
+	s.stopIdleInformers()
+	s.mu.Lock()
+	watched := len(s.watched)
+	s.mu.Unlock()
+	if watched != 0 {
+		t.Fatalf("%v informers left after stopping the idle ones", watched)
+	}
+
+	// started again when needed
+	if _, err := s.Get("certs", "he-key"); err != nil {
+		t.Fatal(err)
+	}
+	if lists, gets := requests.count("he-key"); lists != 2 || gets != 0 {
+		t.Errorf("got %v lists and %v gets, want the informer started again", lists, gets)
+	}
+}
+
+func TestSecretCacheMaxWatched(t *testing.T) {
+	s, _, requests := newSecretTestCache(t)
+	s.maxWatched = 1
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"he-key", "unwatchable"} {
+			if _, err := s.Get("certs", name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if lists, gets := requests.count("he-key"); lists != 1 || gets != 0 {
+		t.Errorf("got %v lists and %v gets of the first secret, want it watched", lists, gets)
+	}
+	if lists, gets := requests.count("unwatchable"); lists != 0 || gets != 2 {
+		t.Errorf("got %v lists and %v gets beyond the limit, want only gets", lists, gets)
+	}
+}
+
+func TestSecretCachePolicy(t *testing.T) {
+	s, _, requests := newSecretTestCache(t)
+	s.policy = secretPolicy{namespaces: []string{"other"}}
+	if _, err := s.Get("certs", "he-key"); err == nil || !strings.Contains(err.Error(), "not among the secrets") {
+		t.Errorf("got %v, want a policy error", err)
+	}
+	if lists, gets := requests.count("he-key"); lists != 0 || gets != 0 {
+		t.Errorf("the secret was read despite the policy")
+	}
+}
+
+func TestSecretUpdateClearsCooldown(t *testing.T) {
+	c := &heProviderSolver{}
+	ctx := context.Background()
+	throttled := &utils.DynamicDnsError{Code: utils.DynamicDnsAbuse, Hostname: "_acme-challenge.example.com"}
+	c.ddnsCooldowns.update(ctx, "_acme-challenge.example.com", secretIdentity("certs", "he-key"), throttled)
+	c.ddnsCooldowns.update(ctx, "_acme-challenge.example.org", secretIdentity("certs", "other-key"), throttled)
+
+	s, client, _ := newSecretTestCache(t)
+	s.onUpdate = func(namespace, name string) {
+		c.ddnsCooldowns.clear(secretIdentity(namespace, name))
+	}
+	if _, err := s.Get("certs", "he-key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Secrets("certs").Update(ctx, credentialSecretObject("he-key", "fixed-key", "2"), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.ddnsCooldowns.check("_acme-challenge.example.com") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the cool-down wasn't cleared when the secret changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.ddnsCooldowns.check("_acme-challenge.example.org"); !errors.Is(err, errDynamicDnsPaused) {
+		t.Errorf("the cool-down of a record using another secret was cleared: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+
+	"github.com/waldner/cert-manager-webhook-he/utils"
+)
+
+var tracer = otel.Tracer(utils.TracerName)
+
+// startTracing exports traces over OTLP (gRPC) if a collector endpoint is
+// set with OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT.
+// The rest of the exporter settings (OTEL_EXPORTER_OTLP_INSECURE,
+// OTEL_EXPORTER_OTLP_HEADERS, ...) are read from the environment too. The
+// returned function flushes the pending spans.
+func startTracing() func() {
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func() {}
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		klog.ErrorS(err, "Cannot create trace exporter, tracing is disabled")
+		return func() {}
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "cert-manager-webhook-he")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		klog.ErrorS(err, "Incomplete trace resource")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	klog.InfoS("Exporting traces over OTLP")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			klog.ErrorS(err, "Error flushing traces")
+		}
+	}
+}
+
+// startChallengeSpan starts the root span of a Present or CleanUp call. The
+// record name is redacted, as traces usually end up in a shared backend.
+func startChallengeSpan(ctx context.Context, operation string, ch *v1alpha1.ChallengeRequest) (context.Context, trace.Span) {
+	return tracer.Start(ctx, operation, trace.WithAttributes(
+		attribute.String("dns.zone", strings.TrimSuffix(ch.ResolvedZone, ".")),
+		attribute.String("dns.record", utils.RedactRecordName(ch.ResolvedFQDN)),
+		attribute.String("k8s.namespace.name", ch.ResourceNamespace),
+	))
+}
+
+// endChallengeSpan ends the root span, adding the method, which is only
+// known once the config has been read
+func endChallengeSpan(span trace.Span, method string, err error) {
+	if method != "" {
+		span.SetAttributes(attribute.String("he.method", method))
+	}
+	endSpan(span, err)
+}
+
+// endSpan ends a span, marking it as failed if err is not nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fetchCredentials gets the credentials from the provider in their own span
+func fetchCredentials(ctx context.Context, provider CredentialProvider, cfg heProviderConfig, ch *v1alpha1.ChallengeRequest) (_ *credentials, err error) {
+	ctx, span := tracer.Start(ctx, "credentials", trace.WithAttributes(
+		attribute.String("he.method", cfg.Method),
+		attribute.String("he.credential_provider", cfg.CredentialProvider),
+	))
+	defer func() { endSpan(span, err) }()
+
+	return provider.Credentials(ctx, cfg, ch)
+}
@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// the changes recorded in the audit log
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+	// a new DDNS key was set for a record; the key itself is never logged
+	AuditSetKey = "set_ddns_key"
+)
+
+// AuditEntry describes a change made to a DNS record at HE. It must never
+// contain credentials or keys.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Method string    `json:"method"`
+	// the challenge (the identifier in the webhook's log lines) and the
+	// namespace of its Issuer, if the change was made for one
+	Challenge string `json:"challenge,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	// which credentials were used: a secret reference, or "ambient" for the
+	// webhook's own
+	Credentials string `json:"credentials"`
+	Zone        string `json:"zone"`
+	Record      string `json:"record"`
+	// the HE record id, when known (it's not with dynamic DNS, nor for
+	// records just created in login mode)
+	RecordId string `json:"recordId,omitempty"`
+	// "success" or "failure"
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// AuditSubject says on whose behalf an HeClient makes its changes
+type AuditSubject struct {
+	Challenge   string
+	Namespace   string
+	Credentials string
+}
+
+// An AuditLog records the changes made to DNS records
+type AuditLog interface {
+	Record(entry AuditEntry)
+}
+
+// NewJsonAuditLog returns an AuditLog writing each entry as a line of JSON
+func NewJsonAuditLog(w io.Writer) AuditLog {
+	return &jsonAuditLog{w: w}
+}
+
+type jsonAuditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *jsonAuditLog) Record(entry AuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		klog.ErrorS(err, "Cannot encode audit entry")
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		klog.ErrorS(err, "Cannot write audit entry")
+	}
+}
+
+// NewLoggerAuditLog returns an AuditLog writing the entries through a logger
+// named "audit", so they end up in the webhook's output but can be told apart
+// from the rest of it
+func NewLoggerAuditLog(logger klog.Logger) AuditLog {
+	return &loggerAuditLog{logger: logger.WithName("audit")}
+}
+
+type loggerAuditLog struct {
+	logger klog.Logger
+}
+
+func (l *loggerAuditLog) Record(e AuditEntry) {
+	l.logger.Info("DNS change",
+		"time", e.Time.Format(time.RFC3339Nano),
+		"action", e.Action,
+		"method", e.Method,
+		"challenge", e.Challenge,
+		"namespace", e.Namespace,
+		"credentials", e.Credentials,
+		"zone", e.Zone,
+		"record", e.Record,
+		"recordId", e.RecordId,
+		"outcome", e.Outcome,
+		"error", e.Error,
+	)
+}
+
+// audit records a change, if there is an audit log
+func (hc *HeClient) audit(action string, zone string, record string, recordId string, err error) {
+	if hc.Audit == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:        time.Now().UTC(),
+		Action:      action,
+		Method:      hc.Method,
+		Challenge:   hc.AuditSubject.Challenge,
+		Namespace:   hc.AuditSubject.Namespace,
+		Credentials: hc.AuditSubject.Credentials,
+		Zone:        strings.TrimSuffix(zone, "."),
+		Record:      strings.TrimSuffix(record, "."),
+		RecordId:    recordId,
+		Outcome:     "success",
+	}
+	if err != nil {
+		entry.Outcome = "failure"
+		entry.Error = err.Error()
+	}
+	hc.Audit.Record(entry)
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	fake := newFakeHe(t, "user", "secret-password", "example.com")
+	var out bytes.Buffer
+	audit := NewJsonAuditLog(&out)
+	subject := AuditSubject{Challenge: "0123456789ab", Namespace: "default", Credentials: "secret:default/he-credentials"}
+
+	client := func(hc *HeClient) *HeClient {
+		hc.Audit, hc.AuditSubject = audit, subject
+		return hc
+	}
+
+	ctx := context.Background()
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+	if err := client(fake.client()).AddTxtRecordWithLogin(ctx, ch); err != nil {
+		t.Fatalf("AddTxtRecordWithLogin: %v", err)
+	}
+	if err := client(fake.client()).RemoveTxtRecordWithLogin(ctx, ch); err != nil {
+		t.Fatalf("RemoveTxtRecordWithLogin: %v", err)
+	}
+	ddnsKey, err := client(fake.client()).ProvisionDynamicDns(ctx, "_acme-challenge.www.example.com", "example.com", "")
+	if err != nil {
+		t.Fatalf("ProvisionDynamicDns: %v", err)
+	}
+	ch = challengeRequest("_acme-challenge.www.example.com.", "example.com.", "challenge-key")
+	if err := client(fake.dynamicDnsClient("wrong-key")).AddTxtRecordWithDynamicDns(ctx, ch); err == nil {
+		t.Fatalf("expected a failure with a wrong key")
+	}
+	// not audited: nothing is changed when login fails
+	hc := client(fake.client())
+	hc.Password = "wrong"
+	if err := hc.AddTxtRecordWithLogin(ctx, ch); err == nil {
+		t.Fatalf("expected a login failure")
+	}
+
+	want := []struct{ action, record, outcome string }{
+		{AuditCreate, "_acme-challenge.example.com", "success"},
+		{AuditDelete, "_acme-challenge.example.com", "success"},
+		{AuditCreate, "_acme-challenge.www.example.com", "success"},
+		{AuditSetKey, "_acme-challenge.www.example.com", "success"},
+		{AuditUpdate, "_acme-challenge.www.example.com", "failure"},
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %v audit entries, want %v:\n%v", len(lines), len(want), out.String())
+	}
+	for i, line := range lines {
+		entry := AuditEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		if entry.Action != want[i].action || entry.Record != want[i].record || entry.Outcome != want[i].outcome {
+			t.Errorf("entry %v = %v %v %v, want %v", i, entry.Action, entry.Record, entry.Outcome, want[i])
+		}
+		if entry.Zone != "example.com" || entry.Challenge != "0123456789ab" || entry.Namespace != "default" || entry.Credentials != subject.Credentials || entry.Time.IsZero() {
+			t.Errorf("entry %v is missing fields: %+v", i, entry)
+		}
+		if entry.Action == AuditDelete && entry.RecordId == "" {
+			t.Errorf("entry %v has no record id", i)
+		}
+	}
+
+	for _, secret := range []string{"secret-password", ddnsKey, "wrong-key", "challenge-key"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("the audit log contains %q", secret)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// Package cassette records the HTTP exchanges of an HeClient with HE, scrubbed
+// of credentials, and replays them in tests, so that the client can be
+// checked against real pages of the control panel without an account.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces the values of the sensitive form fields and cookies
+const Redacted = "REDACTED"
+
+// form fields holding credentials or keys, whose values are never stored
+var sensitiveFields = map[string]bool{
+	"email":    true,
+	"pass":     true,
+	"password": true,
+	"tfacode":  true,
+	"Key":      true,
+	"Key2":     true,
+}
+
+// the response headers that are kept (Set-Cookie with its value scrubbed)
+var keptHeaders = []string{"Content-Type", "Location", "Set-Cookie"}
+
+// Cassette is a recorded sequence of HTTP exchanges
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a request and the response it got
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is the part of a request that is recorded and matched on replay.
+// No headers are kept, so no cookies.
+type Request struct {
+	Method string              `json:"method"`
+	URL    string              `json:"url"`
+	Form   map[string][]string `json:"form,omitempty"`
+}
+
+// Response is a recorded response
+type Response struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    string              `json:"body"`
+}
+
+// Load reads a cassette from a file
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("cannot decode cassette %v: %v", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cassette to a file
+func (c *Cassette) Save(path string) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// keep the pages readable in the cassette files
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// Scrubber removes the sensitive parts of the exchanges before they're
+// recorded:
+//   - the values of the credential form fields (and wherever they're echoed
+//     in the pages) are replaced by Redacted
+//   - the values of the cookies set by HE are replaced by Redacted
+//   - zone and record ids are renumbered, consistently across the cassette
+//   - the given literal replacements are made everywhere (eg the real zone
+//     name by example.com, or the URL of a test server by https://dns.he.net/)
+type Scrubber struct {
+	replacements map[string]string
+
+	mu      sync.Mutex
+	secrets []string
+	ids     map[string]string
+	zones   int
+	records int
+}
+
+// NewScrubber returns a scrubber making the given literal replacements on
+// top of the built-in rules
+func NewScrubber(replacements map[string]string) *Scrubber {
+	return &Scrubber{replacements: replacements, ids: map[string]string{}}
+}
+
+// where zone and record ids show up in the requests and pages of HE
+var (
+	zoneIdPattern   = regexp.MustCompile(`hosted_dns_zoneid=([0-9]+)`)
+	recordIdPattern = regexp.MustCompile(`(?:class="dns_tr" id="|deleteRecord\(')([0-9]+)`)
+	numberPattern   = regexp.MustCompile(`[0-9]+`)
+)
+
+// learn renumbers the ids found in s, zone ids from 100001 and record ids
+// from 200001
+func (s *Scrubber) learn(text string) {
+	for _, m := range zoneIdPattern.FindAllStringSubmatch(text, -1) {
+		s.learnId(m[1], &s.zones, 100000)
+	}
+	for _, m := range recordIdPattern.FindAllStringSubmatch(text, -1) {
+		s.learnId(m[1], &s.records, 200000)
+	}
+}
+
+func (s *Scrubber) learnId(id string, counter *int, base int) {
+	if _, ok := s.ids[id]; ok || id == "" {
+		return
+	}
+	*counter++
+	s.ids[id] = strconv.Itoa(base + *counter)
+}
+
+// scrub applies the replacements, the ids and the secrets to a string
+func (s *Scrubber) scrub(text string) string {
+	for _, secret := range s.secrets {
+		// as it is, and as it would appear in HTML or in a URL
+		for _, encoded := range []string{secret, html.EscapeString(secret), url.QueryEscape(secret)} {
+			text = strings.ReplaceAll(text, encoded, Redacted)
+		}
+	}
+	// longest first, so that a replacement doesn't break a longer one
+	from := make([]string, 0, len(s.replacements))
+	for f := range s.replacements {
+		from = append(from, f)
+	}
+	sort.Slice(from, func(i, j int) bool { return len(from[i]) > len(from[j]) })
+	for _, f := range from {
+		text = strings.ReplaceAll(text, f, s.replacements[f])
+	}
+	if len(s.ids) > 0 {
+		text = numberPattern.ReplaceAllStringFunc(text, func(n string) string {
+			if id, ok := s.ids[n]; ok {
+				return id
+			}
+			return n
+		})
+	}
+	return text
+}
+
+func (s *Scrubber) scrubRequest(r Request) Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, values := range r.Form {
+		if sensitiveFields[name] {
+			for _, v := range values {
+				if v != "" && !contains(s.secrets, v) {
+					s.secrets = append(s.secrets, v)
+				}
+			}
+		}
+	}
+	s.learn(r.URL)
+	for _, name := range []string{"hosted_dns_zoneid", "hosted_dns_recordid"} {
+		for _, v := range r.Form[name] {
+			s.learn(name + "=" + v)
+			if name == "hosted_dns_recordid" {
+				s.learnId(v, &s.records, 200000)
+			}
+		}
+	}
+
+	out := Request{Method: r.Method, URL: s.scrub(r.URL)}
+	if len(r.Form) > 0 {
+		out.Form = map[string][]string{}
+		for name, values := range r.Form {
+			for _, v := range values {
+				if sensitiveFields[name] {
+					v = Redacted
+				}
+				out.Form[name] = append(out.Form[name], s.scrub(v))
+			}
+		}
+	}
+	return out
+}
+
+func (s *Scrubber) scrubResponse(r Response) Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.learn(r.Body)
+	out := Response{Status: r.Status, Body: s.scrub(r.Body)}
+	for name, values := range r.Headers {
+		for _, v := range values {
+			if name == "Set-Cookie" {
+				v = scrubCookie(v)
+			}
+			if out.Headers == nil {
+				out.Headers = map[string][]string{}
+			}
+			out.Headers[name] = append(out.Headers[name], s.scrub(v))
+		}
+	}
+	return out
+}
+
+// scrubCookie replaces the value of a Set-Cookie header, keeping the name
+// and the attributes so that the client handles it the same way
+func scrubCookie(header string) string {
+	nameValue, attributes, _ := strings.Cut(header, ";")
+	name, _, _ := strings.Cut(nameValue, "=")
+	if attributes != "" {
+		attributes = ";" + attributes
+	}
+	return name + "=" + Redacted + attributes
+}
+
+// Recorder is an http.RoundTripper that makes the requests through
+// Transport, recording them scrubbed
+type Recorder struct {
+	// the real transport; http.DefaultTransport if nil
+	Transport http.RoundTripper
+	Scrubber  *Scrubber
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder returns a recorder that scrubs with the given scrubber
+func NewRecorder(transport http.RoundTripper, scrubber *Scrubber) *Recorder {
+	return &Recorder{Transport: transport, Scrubber: scrubber}
+}
+
+func (rec *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, req, err := readRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := rec.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	response := Response{Status: resp.StatusCode, Body: string(body)}
+	for _, name := range keptHeaders {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			if response.Headers == nil {
+				response.Headers = map[string][]string{}
+			}
+			response.Headers[name] = values
+		}
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.cassette.Interactions = append(rec.cassette.Interactions, Interaction{
+		Request:  rec.Scrubber.scrubRequest(request),
+		Response: rec.Scrubber.scrubResponse(response),
+	})
+	return resp, nil
+}
+
+// Cassette returns what has been recorded so far
+func (rec *Recorder) Cassette() *Cassette {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &Cassette{Interactions: append([]Interaction(nil), rec.cassette.Interactions...)}
+}
+
+// Player is an http.RoundTripper that serves the responses of a cassette,
+// as long as the requests come in the recorded order. The values of the
+// sensitive fields are not compared, so the client can use any credentials.
+type Player struct {
+	mu       sync.Mutex
+	cassette *Cassette
+	next     int
+	err      error
+}
+
+// NewPlayer returns a player for the cassette
+func NewPlayer(c *Cassette) *Player {
+	return &Player{cassette: c}
+}
+
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, error) {
+	request, req, err := readRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	for name := range request.Form {
+		if sensitiveFields[name] {
+			request.Form[name] = []string{Redacted}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next >= len(p.cassette.Interactions) {
+		return nil, p.fail(fmt.Errorf("cassette: unexpected request %v %v after the end of the cassette", request.Method, request.URL))
+	}
+	want := p.cassette.Interactions[p.next]
+	if request.Method != want.Request.Method || request.URL != want.Request.URL || !reflect.DeepEqual(request.Form, want.Request.Form) {
+		return nil, p.fail(fmt.Errorf("cassette: request #%d is %v %v %v, want %v %v %v",
+			p.next, request.Method, request.URL, request.Form, want.Request.Method, want.Request.URL, want.Request.Form))
+	}
+	p.next++
+
+	header := http.Header{}
+	for name, values := range want.Response.Headers {
+		for _, v := range values {
+			header.Add(name, v)
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", want.Response.Status, http.StatusText(want.Response.Status)),
+		StatusCode:    want.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(want.Response.Body)),
+		ContentLength: int64(len(want.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// fail remembers the first mismatch, which the client may not report as is
+func (p *Player) fail(err error) error {
+	if p.err == nil {
+		p.err = err
+	}
+	return err
+}
+
+// Done tells whether the client made exactly the recorded requests
+func (p *Player) Done() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if p.next < len(p.cassette.Interactions) {
+		missing := p.cassette.Interactions[p.next].Request
+		return fmt.Errorf("cassette: %d requests were not made, starting with %v %v", len(p.cassette.Interactions)-p.next, missing.Method, missing.URL)
+	}
+	return nil
+}
+
+// readRequest returns the recorded form of req, and a copy of req whose
+// body can still be sent
+func readRequest(req *http.Request) (Request, *http.Request, error) {
+	r := Request{Method: req.Method, URL: req.URL.String()}
+	if req.Body == nil || req.Body == http.NoBody {
+		return r, req, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return r, nil, err
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	if ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); ct == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return r, nil, err
+		}
+		r.Form = form
+	}
+	return r, req, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package cassette
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		http.SetCookie(w, &http.Cookie{Name: "CGISESSID", Value: "real-session", Path: "/"})
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, `<p>Welcome `+r.Form.Get("email")+` &amp; p&lt;ss</p>`+
+			`<a href="?hosted_dns_zoneid=4321&menu=edit_zone">real.example.org</a>`+
+			`<tr class="dns_tr" id="98765"><td>4321</td><td>98765</td><td>3600</td></tr>`)
+	}))
+	defer server.Close()
+
+	recorder := NewRecorder(nil, NewScrubber(map[string]string{
+		server.URL + "/":   "https://dns.he.net/",
+		"real.example.org": "example.com",
+	}))
+	client := &http.Client{Transport: recorder}
+	resp, err := client.PostForm(server.URL+"/", url.Values{"email": {"someone"}, "pass": {"p<ss"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "someone") {
+		t.Errorf("the client got a scrubbed page: %s", body)
+	}
+	if _, err := client.Get(server.URL + "/?hosted_dns_zoneid=4321&menu=edit_zone"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	if err := recorder.Cassette().Save(path); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := c.Interactions[0]
+	if first.Request.URL != "https://dns.he.net/" || first.Request.Form["email"][0] != Redacted || first.Request.Form["pass"][0] != Redacted {
+		t.Errorf("request not scrubbed: %+v", first.Request)
+	}
+	if got := first.Response.Headers["Set-Cookie"]; len(got) != 1 || got[0] != "CGISESSID="+Redacted+"; Path=/" {
+		t.Errorf("cookie not scrubbed: %v", got)
+	}
+	want := `<p>Welcome REDACTED &amp; REDACTED</p>` +
+		`<a href="?hosted_dns_zoneid=100001&menu=edit_zone">example.com</a>` +
+		`<tr class="dns_tr" id="200001"><td>100001</td><td>200001</td><td>3600</td></tr>`
+	if first.Response.Body != want {
+		t.Errorf("body not scrubbed:\n got %v\nwant %v", first.Response.Body, want)
+	}
+	if got := c.Interactions[1].Request.URL; got != "https://dns.he.net/?hosted_dns_zoneid=100001&menu=edit_zone" {
+		t.Errorf("zone id not renumbered in %v", got)
+	}
+
+	// any credentials are accepted, but not another request
+	player := NewPlayer(c)
+	client = &http.Client{Transport: player}
+	if _, err := client.PostForm("https://dns.he.net/", url.Values{"email": {"other"}, "pass": {"other"}}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if _, err := client.Get("https://dns.he.net/?hosted_dns_zoneid=100002&menu=edit_zone"); err == nil {
+		t.Errorf("replay accepted a request for another zone")
+	}
+	if err := player.Done(); err == nil {
+		t.Errorf("Done accepted a mismatched request")
+	}
+
+	player = NewPlayer(c)
+	client = &http.Client{Transport: player}
+	client.PostForm("https://dns.he.net/", url.Values{"email": {"other"}, "pass": {"other"}})
+	if err := player.Done(); err == nil || !strings.Contains(err.Error(), "1 requests were not made") {
+		t.Errorf("Done accepted a missing request: %v", err)
+	}
+}
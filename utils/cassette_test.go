@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+
+	"github.com/waldner/cert-manager-webhook-he/utils/cassette"
+)
+
+// With -record-cassettes=fake, the cassettes are recorded again against the
+// fake panel; with -record-cassettes=he, against dns.he.net, using the account
+// in HE_USERNAME and HE_PASSWORD and the zone in HE_TEST_ZONE (a TXT record is
+// added to it and deleted).
+var recordCassettes = flag.String("record-cassettes", "", `record the cassettes against "fake" or "he" instead of replaying them`)
+
+const cassetteDir = "testdata/cassettes"
+
+// the flows covered by the cassettes, for the record _acme-challenge.<zone>
+var cassetteFlows = []struct {
+	name string
+	// made before recording, to get the account in the right state
+	setup func(ctx context.Context, hc *HeClient, zone string) error
+	run   func(ctx context.Context, hc *HeClient, zone string) error
+}{
+	{
+		name: "login_add",
+		run: func(ctx context.Context, hc *HeClient, zone string) error {
+			return hc.AddTxtRecordWithLogin(ctx, cassetteChallenge(zone))
+		},
+	},
+	{
+		name: "login_delete",
+		setup: func(ctx context.Context, hc *HeClient, zone string) error {
+			return hc.AddTxtRecordWithLogin(ctx, cassetteChallenge(zone))
+		},
+		run: func(ctx context.Context, hc *HeClient, zone string) error {
+			return hc.RemoveTxtRecordWithLogin(ctx, cassetteChallenge(zone))
+		},
+	},
+}
+
+func cassetteChallenge(zone string) *v1alpha1.ChallengeRequest {
+	return challengeRequest("_acme-challenge."+zone+".", zone+".", "cassette-challenge-key")
+}
+
+// cassetteClient returns a login-mode HeClient going through transport
+func cassetteClient(t *testing.T, heUrl, username, password string, transport http.RoundTripper) *HeClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &HeClient{
+		Username: username,
+		Password: password,
+		HeUrl:    heUrl,
+		Method:   "login",
+		Client:   &http.Client{Jar: jar, Transport: transport},
+	}
+}
+
+func TestCassettes(t *testing.T) {
+	if *recordCassettes != "" {
+		recordAllCassettes(t)
+		return
+	}
+
+	for _, flow := range cassetteFlows {
+		t.Run(flow.name, func(t *testing.T) {
+			c, err := cassette.Load(filepath.Join(cassetteDir, flow.name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			player := cassette.NewPlayer(c)
+			hc := cassetteClient(t, "https://dns.he.net/", "user", "any-password", player)
+			if err := flow.run(context.Background(), hc, "example.com"); err != nil {
+				t.Fatalf("%v: %v", flow.name, err)
+			}
+			if err := player.Done(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCassetteRequestMismatch(t *testing.T) {
+	c, err := cassette.Load(filepath.Join(cassetteDir, "login_add.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a different flow
+	player := cassette.NewPlayer(c)
+	hc := cassetteClient(t, "https://dns.he.net/", "user", "any-password", player)
+	if err := hc.RemoveTxtRecordWithLogin(context.Background(), cassetteChallenge("example.com")); err == nil {
+		t.Errorf("RemoveTxtRecordWithLogin succeeded against the cassette of an addition")
+	}
+	if err := player.Done(); err == nil {
+		t.Errorf("the player accepted a different sequence of requests")
+	}
+
+	// the same flow with a different record
+	player = cassette.NewPlayer(c)
+	hc = cassetteClient(t, "https://dns.he.net/", "user", "any-password", player)
+	ch := challengeRequest("_acme-challenge.www.example.com.", "example.com.", "cassette-challenge-key")
+	hc.AddTxtRecordWithLogin(context.Background(), ch)
+	if err := player.Done(); err == nil || !strings.Contains(err.Error(), "www") {
+		t.Errorf("the player accepted a request for another record: %v", err)
+	}
+}
+
+func recordAllCassettes(t *testing.T) {
+	var heUrl, username, password, zone string
+	var replacements map[string]string
+
+	switch *recordCassettes {
+	case "fake":
+		zone = "example.com"
+		fake := newFakeHe(t, "user", "secret-password", zone)
+		heUrl, username, password = fake.URL+"/", fake.Username, fake.Password
+		replacements = map[string]string{heUrl: "https://dns.he.net/"}
+	case "he":
+		heUrl = "https://dns.he.net/"
+		username, password, zone = os.Getenv("HE_USERNAME"), os.Getenv("HE_PASSWORD"), os.Getenv("HE_TEST_ZONE")
+		if username == "" || password == "" || zone == "" {
+			t.Fatal("HE_USERNAME, HE_PASSWORD and HE_TEST_ZONE must be set")
+		}
+		zone = strings.TrimSuffix(zone, ".")
+		replacements = map[string]string{zone: "example.com"}
+	default:
+		t.Fatalf("unknown -record-cassettes %q", *recordCassettes)
+	}
+
+	ctx := context.Background()
+	for _, flow := range cassetteFlows {
+		if flow.setup != nil {
+			if err := flow.setup(ctx, cassetteClient(t, heUrl, username, password, nil), zone); err != nil {
+				t.Fatalf("%v setup: %v", flow.name, err)
+			}
+		}
+		recorder := cassette.NewRecorder(nil, cassette.NewScrubber(replacements))
+		if err := flow.run(ctx, cassetteClient(t, heUrl, username, password, recorder), zone); err != nil {
+			t.Fatalf("%v: %v", flow.name, err)
+		}
+		if err := recorder.Cassette().Save(filepath.Join(cassetteDir, flow.name+".json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
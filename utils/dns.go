@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// DefaultNameservers are the authoritative nameservers of HE
+var DefaultNameservers = []string{"ns1.he.net", "ns2.he.net", "ns3.he.net", "ns4.he.net", "ns5.he.net"}
+
+// timeout of each DNS query
+const dnsTimeout = 5 * time.Second
+
+// exchangeDns sends a query to server, giving up when ctx is done. The dns
+// client only follows the deadline of ctx, so the connection is closed on
+// cancellation to stop waiting for the answer.
+func exchangeDns(ctx context.Context, m *dns.Msg, server string) (*dns.Msg, error) {
+	c := &dns.Client{Timeout: dnsTimeout}
+	conn, err := c.DialContext(ctx, withPort(server))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	r, _, err := c.ExchangeWithConnContext(ctx, m, conn)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return r, err
+}
+
+// QueryTxt asks a nameserver for the TXT records of fqdn, without recursion.
+// A name that doesn't exist has no records.
+func QueryTxt(ctx context.Context, server string, fqdn string) ([]string, error) {
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+	m.RecursionDesired = false
+
+	r, err := exchangeDns(ctx, m, server)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query %v: %w", server, err)
+	}
+	if r.Rcode == dns.RcodeNameError {
+		return []string{}, nil
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("cannot query %v: got %v", server, dns.RcodeToString[r.Rcode])
+	}
+
+	values := []string{}
+	for _, rr := range r.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			values = append(values, strings.Join(txt.Txt, ""))
+		}
+	}
+	return values, nil
+}
+
+// currentTxt returns the TXT records of fqdn according to the first of the
+// nameservers that answers
+func currentTxt(ctx context.Context, servers []string, fqdn string) ([]string, error) {
+	logger := klog.FromContext(ctx)
+	var errs []string
+	for _, server := range servers {
+		values, err := QueryTxt(ctx, server, fqdn)
+		if err == nil {
+			logger.V(4).Info("Current TXT records", "fqdn", fqdn, "server", server, "values", values)
+			return values, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, fmt.Errorf("no nameserver answered: %v", strings.Join(errs, "; "))
+}
+
+// add the default DNS port to a server address that has none
+func withPort(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+// WaitForTxt polls all the nameservers until every one of them serves value
+// as a TXT record of fqdn, or the timeout passes, or ctx is done
+func WaitForTxt(ctx context.Context, servers []string, fqdn string, value string, timeout time.Duration, interval time.Duration) error {
+
+	logger := klog.FromContext(ctx)
+	deadline := time.Now().Add(timeout)
+	// so that a slow query doesn't overrun the timeout either
+	queryCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	pending := servers
+	for {
+		missing := []string{}
+		for _, server := range pending {
+			values, err := QueryTxt(queryCtx, server, fqdn)
+			if err != nil {
+				logger.V(4).Info("Cannot check propagation", "server", server, "err", err)
+			}
+			if err != nil || !contains(values, value) {
+				missing = append(missing, server)
+			}
+		}
+		if len(missing) == 0 {
+			logger.Info("Record propagated to all nameservers", "fqdn", fqdn, "servers", servers)
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("record %v not propagated after %v, missing on %v", fqdn, timeout, strings.Join(missing, ", "))
+		}
+		logger.V(2).Info("Waiting for propagation", "fqdn", fqdn, "missing", missing)
+		pending = missing
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// heNameserver matches the names of HE's nameservers
+var heNameserver = regexp.MustCompile(`^ns[0-9]+\.he\.net\.?$`)
+
+// LookupNS resolves the NS records of zone through the given recursive
+// resolvers (the ones in /etc/resolv.conf if empty), using the first one that
+// answers
+func LookupNS(ctx context.Context, resolvers []string, zone string) ([]string, error) {
+
+	if len(resolvers) == 0 {
+		conf, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			return nil, fmt.Errorf("cannot read resolver config: %v", err)
+		}
+		for _, s := range conf.Servers {
+			resolvers = append(resolvers, net.JoinHostPort(s, conf.Port))
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeNS)
+
+	var errs []string
+	for _, resolver := range resolvers {
+		r, err := exchangeDns(ctx, m, resolver)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("cannot query %v: %v", resolver, err))
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			errs = append(errs, fmt.Sprintf("cannot query %v: got %v", resolver, dns.RcodeToString[r.Rcode]))
+			continue
+		}
+		names := []string{}
+		for _, rr := range r.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				names = append(names, strings.ToLower(strings.TrimSuffix(ns.Ns, ".")))
+			}
+		}
+		return names, nil
+	}
+	return nil, fmt.Errorf("cannot resolve the nameservers of %v: %v", zone, strings.Join(errs, "; "))
+}
+
+// CheckDelegation tells whether all the given nameservers of a zone are
+// HE's, returning an error describing the problem otherwise
+func CheckDelegation(zone string, nameservers []string) error {
+	zone = strings.TrimSuffix(zone, ".")
+	if len(nameservers) == 0 {
+		return fmt.Errorf("%w: zone %v has no NS records", ErrNotDelegated, zone)
+	}
+	others := []string{}
+	for _, ns := range nameservers {
+		if !heNameserver.MatchString(ns) {
+			others = append(others, ns)
+		}
+	}
+	if len(others) == len(nameservers) {
+		return fmt.Errorf("%w: the nameservers of zone %v are %v, change the NS records at the registrar to ns1.he.net to ns5.he.net", ErrNotDelegated, zone, strings.Join(nameservers, ", "))
+	}
+	if len(others) > 0 {
+		return fmt.Errorf("%w: zone %v is only partly delegated to HE, it also uses %v", ErrNotDelegated, zone, strings.Join(others, ", "))
+	}
+	return nil
+}
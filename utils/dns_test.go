@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveWithDynamicDnsChecksCurrentValue(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	if _, err := fake.client().ProvisionDynamicDns(context.Background(), "_acme-challenge.example.com", "example.com", "ddns-key"); err != nil {
+		t.Fatalf("ProvisionDynamicDns: %v", err)
+	}
+
+	hc := fake.dynamicDnsClient("ddns-key")
+	hc.Nameservers = []string{fake.DNSServer()}
+	hc.Placeholder = "none"
+
+	first := challengeRequest("_acme-challenge.example.com.", "example.com.", "first-key")
+	second := challengeRequest("_acme-challenge.example.com.", "example.com.", "second-key")
+
+	if err := hc.AddTxtRecordWithDynamicDns(context.Background(), first); err != nil {
+		t.Fatalf("AddTxtRecordWithDynamicDns: %v", err)
+	}
+	if err := hc.AddTxtRecordWithDynamicDns(context.Background(), second); err != nil {
+		t.Fatalf("AddTxtRecordWithDynamicDns: %v", err)
+	}
+
+	// the record has the key of the second challenge, so the first one leaves it alone
+	if err := hc.RemoveTxtRecordWithDynamicDns(context.Background(), first); err != nil {
+		t.Fatalf("RemoveTxtRecordWithDynamicDns: %v", err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.example.com"); !reflect.DeepEqual(got, []string{"second-key"}) {
+		t.Fatalf("record changed by a stale CleanUp: %v", got)
+	}
+
+	if err := hc.RemoveTxtRecordWithDynamicDns(context.Background(), second); err != nil {
+		t.Fatalf("RemoveTxtRecordWithDynamicDns: %v", err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.example.com"); !reflect.DeepEqual(got, []string{"none"}) {
+		t.Fatalf("record not reset to the placeholder: %v", got)
+	}
+
+	// if no nameserver answers, the record is reset anyway
+	if err := hc.AddTxtRecordWithDynamicDns(context.Background(), first); err != nil {
+		t.Fatalf("AddTxtRecordWithDynamicDns: %v", err)
+	}
+	hc.Nameservers = []string{"127.0.0.1:1"}
+	if err := hc.RemoveTxtRecordWithDynamicDns(context.Background(), first); err != nil {
+		t.Fatalf("RemoveTxtRecordWithDynamicDns: %v", err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.example.com"); !reflect.DeepEqual(got, []string{"none"}) {
+		t.Fatalf("record not reset without nameservers: %v", got)
+	}
+}
+
+func TestQueryTxt(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	fake.SetTxtRecord("1", "example.com", "_acme-challenge.example.com", "a")
+	fake.SetTxtRecord("2", "example.com", "_acme-challenge.example.com", "b")
+	server := fake.DNSServer()
+
+	values, err := QueryTxt(context.Background(), server, "_acme-challenge.example.com")
+	if err != nil {
+		t.Fatalf("QueryTxt: %v", err)
+	}
+	if len(values) != 2 || !contains(values, "a") || !contains(values, "b") {
+		t.Errorf("unexpected values %v", values)
+	}
+
+	values, err = QueryTxt(context.Background(), server, "missing.example.com.")
+	if err != nil || len(values) != 0 {
+		t.Errorf("QueryTxt for a missing name = %v, %v", values, err)
+	}
+}
+
+func TestWaitForTxt(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	servers := []string{fake.DNSServer(), fake.DNSServer()}
+
+	if err := WaitForTxt(context.Background(), servers, "_acme-challenge.example.com", "key", 300*time.Millisecond, 100*time.Millisecond); err == nil {
+		t.Errorf("expected a timeout for a missing record")
+	}
+
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		fake.SetTxtRecord("1", "example.com", "_acme-challenge.example.com", "key")
+	}()
+	if err := WaitForTxt(context.Background(), servers, "_acme-challenge.example.com.", "key", 5*time.Second, 50*time.Millisecond); err != nil {
+		t.Errorf("WaitForTxt: %v", err)
+	}
+
+	// cancelling stops the wait right away
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if err := WaitForTxt(ctx, servers, "_acme-challenge.example.com", "other", time.Minute, 10*time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the context error", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("WaitForTxt took %v to notice the cancellation", time.Since(start))
+	}
+}
+
+func TestQueryTxtCancel(t *testing.T) {
+	// a nameserver that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	if _, err := QueryTxt(ctx, pc.LocalAddr().String(), "_acme-challenge.example.com"); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the context error", err)
+	}
+	if time.Since(start) >= dnsTimeout {
+		t.Errorf("the query went on for %v after the cancellation", time.Since(start))
+	}
+
+	// the propagation timeout also bounds the queries
+	start = time.Now()
+	if err := WaitForTxt(context.Background(), []string{pc.LocalAddr().String()}, "_acme-challenge.example.com", "key", 300*time.Millisecond, 100*time.Millisecond); err == nil {
+		t.Errorf("expected a timeout")
+	}
+	if time.Since(start) >= dnsTimeout {
+		t.Errorf("WaitForTxt took %v with a 300ms timeout", time.Since(start))
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	resolver := fake.DNSServer()
+
+	nameservers, err := LookupNS(context.Background(), []string{"127.0.0.1:1", resolver}, "example.com.")
+	if err != nil {
+		t.Fatalf("LookupNS: %v", err)
+	}
+	if len(nameservers) != 5 || nameservers[0] != "ns1.he.net" {
+		t.Errorf("unexpected nameservers %v", nameservers)
+	}
+	if err := CheckDelegation("example.com.", nameservers); err != nil {
+		t.Errorf("CheckDelegation: %v", err)
+	}
+
+	fake.SetDelegation("ns1.registrar.example.", "ns2.registrar.example.")
+	nameservers, err = LookupNS(context.Background(), []string{resolver}, "example.com")
+	if err != nil {
+		t.Fatalf("LookupNS: %v", err)
+	}
+	if err := CheckDelegation("example.com", nameservers); !errors.Is(err, ErrNotDelegated) || !strings.Contains(err.Error(), "ns1.registrar.example") {
+		t.Errorf("expected a delegation error, got %v", err)
+	}
+
+	fake.SetDelegation("ns1.he.net.", "ns1.registrar.example.")
+	nameservers, _ = LookupNS(context.Background(), []string{resolver}, "example.com")
+	if err := CheckDelegation("example.com", nameservers); err == nil || !strings.Contains(err.Error(), "partly") {
+		t.Errorf("expected a partial delegation error, got %v", err)
+	}
+
+	if _, err := LookupNS(context.Background(), []string{resolver}, "example.org"); err == nil {
+		t.Errorf("expected an error for a missing zone")
+	}
+}
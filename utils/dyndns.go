@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// the result codes of the dynamic DNS endpoint (dyndns2 protocol)
+const (
+	DynamicDnsGood     = "good"
+	DynamicDnsNoChange = "nochg"
+	DynamicDnsBadAuth  = "badauth"
+	DynamicDnsNoHost   = "nohost"
+	DynamicDnsNotFqdn  = "notfqdn"
+	DynamicDnsAbuse    = "abuse"
+	DynamicDnsInterval = "interval"
+	DynamicDnsServer   = "911"
+)
+
+// DynamicDnsError is an unsuccessful answer of the dynamic DNS endpoint
+type DynamicDnsError struct {
+	// the result code, or "" for an empty or unknown answer
+	Code     string
+	Hostname string
+	// the whole answer
+	Body string
+}
+
+func (e *DynamicDnsError) Error() string {
+	switch e.Code {
+	case DynamicDnsBadAuth:
+		return fmt.Sprintf("dynamic DNS authentication failed for %v: check the API key, and that dynamic DNS is enabled for the record", e.Hostname)
+	case DynamicDnsNoHost:
+		return fmt.Sprintf("there is no dynamic DNS record %v: create the TXT record with dynamic DNS enabled in the HE panel (or with provision-ddns)", e.Hostname)
+	case DynamicDnsNotFqdn:
+		return fmt.Sprintf("%v is not a valid fully qualified name for dynamic DNS", e.Hostname)
+	case DynamicDnsAbuse:
+		return fmt.Sprintf("HE has blocked dynamic DNS updates of %v for abuse: too many updates, wait before retrying", e.Hostname)
+	case DynamicDnsInterval:
+		return fmt.Sprintf("dynamic DNS updates of %v are too frequent: wait before retrying", e.Hostname)
+	case DynamicDnsServer:
+		return "the HE dynamic DNS service has a problem (911), retry later"
+	}
+	if strings.TrimSpace(e.Body) == "" {
+		return fmt.Sprintf("empty response from the dynamic DNS service for %v", e.Hostname)
+	}
+	return fmt.Sprintf("unexpected response from the dynamic DNS service for %v: '%v'", e.Hostname, e.Body)
+}
+
+// Throttled tells whether HE asked to slow down
+func (e *DynamicDnsError) Throttled() bool {
+	return e.Code == DynamicDnsAbuse || e.Code == DynamicDnsInterval
+}
+
+// IsThrottled tells whether err is (or wraps) a DynamicDnsError asking to
+// slow down, and returns it
+func IsThrottled(err error) (*DynamicDnsError, bool) {
+	var de *DynamicDnsError
+	if errors.As(err, &de) && de.Throttled() {
+		return de, true
+	}
+	return nil, false
+}
+
+// parseDynamicDnsResponse returns nil if the answer to an update of hostname
+// is successful ("good" or "nochg", followed by the value), and a
+// DynamicDnsError otherwise
+func parseDynamicDnsResponse(hostname string, body string) error {
+	code, _, _ := strings.Cut(strings.TrimSpace(body), " ")
+	switch code {
+	case DynamicDnsGood, DynamicDnsNoChange:
+		return nil
+	case DynamicDnsBadAuth, DynamicDnsNoHost, DynamicDnsNotFqdn, DynamicDnsAbuse, DynamicDnsInterval, DynamicDnsServer:
+		return &DynamicDnsError{Code: code, Hostname: hostname, Body: body}
+	}
+	return &DynamicDnsError{Hostname: hostname, Body: body}
+}
+
+// the result code of an answer, for the metrics
+func dynamicDnsResultCode(body string, err error) string {
+	if de, ok := err.(*DynamicDnsError); ok {
+		if de.Code != "" {
+			return de.Code
+		}
+		if strings.TrimSpace(body) == "" {
+			return "empty"
+		}
+		return "unknown"
+	}
+	code, _, _ := strings.Cut(strings.TrimSpace(body), " ")
+	return code
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDynamicDnsResponse(t *testing.T) {
+	tests := []struct {
+		body      string
+		code      string
+		throttled bool
+		message   string
+	}{
+		{"good some-value", "", false, ""},
+		{"nochg some-value", "", false, ""},
+		{"nochg", "", false, ""},
+		{"badauth", DynamicDnsBadAuth, false, "check the API key"},
+		{"nohost", DynamicDnsNoHost, false, "provision-ddns"},
+		{"notfqdn", DynamicDnsNotFqdn, false, "not a valid fully qualified name"},
+		{"abuse", DynamicDnsAbuse, true, "blocked"},
+		{"interval\n", DynamicDnsInterval, true, "too frequent"},
+		{"911", DynamicDnsServer, false, "retry later"},
+		{"", "", false, "empty response"},
+		{"ok", "", false, "unexpected response"},
+		{"goodbye", "", false, "unexpected response"},
+	}
+	for _, tt := range tests {
+		err := parseDynamicDnsResponse("_acme-challenge.example.com", tt.body)
+		if tt.message == "" {
+			if err != nil {
+				t.Errorf("response %q: unexpected error %v", tt.body, err)
+			}
+			continue
+		}
+		de, ok := err.(*DynamicDnsError)
+		if !ok {
+			t.Errorf("response %q: expected a DynamicDnsError, got %v", tt.body, err)
+			continue
+		}
+		if de.Code != tt.code || de.Throttled() != tt.throttled || !strings.Contains(de.Error(), tt.message) {
+			t.Errorf("response %q: got code %q, throttled %v, message %q", tt.body, de.Code, de.Throttled(), de.Error())
+		}
+		if _, throttled := IsThrottled(err); throttled != tt.throttled {
+			t.Errorf("response %q: IsThrottled = %v", tt.body, throttled)
+		}
+	}
+}
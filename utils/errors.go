@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/antchfx/htmlquery"
+	"golang.org/x/net/html"
+)
+
+var (
+	// ErrLoginFailed is returned (wrapped) when HE rejects the credentials
+	ErrLoginFailed = errors.New("login failed (invalid credentials?)")
+	// ErrZoneNotFound is returned (wrapped) when the zone is not in the HE account
+	ErrZoneNotFound = errors.New("zone not found in the HE account")
+	// ErrNotDelegated is returned (wrapped) when a zone is not delegated to HE
+	ErrNotDelegated = errors.New("zone not delegated to HE")
+)
+
+// LayoutError is returned when a page from HE doesn't look like expected,
+// which usually means the control panel HTML has changed
+type LayoutError struct {
+	msg string
+}
+
+func (e *LayoutError) Error() string {
+	return e.msg
+}
+
+func layoutErrorf(format string, args ...interface{}) error {
+	return &LayoutError{msg: fmt.Sprintf(format, args...)}
+}
+
+// IsLayoutError tells whether err is (or wraps) a LayoutError
+func IsLayoutError(err error) bool {
+	var le *LayoutError
+	return errors.As(err, &le)
+}
+
+// find the first node matching xpath, or fail with a LayoutError
+func findOne(top *html.Node, xpath string) (*html.Node, error) {
+	node := htmlquery.FindOne(top, xpath)
+	if node == nil {
+		return nil, layoutErrorf("cannot find %v in page", xpath)
+	}
+	return node, nil
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestLayoutError(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	fake.BrokenLayout = true
+
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+
+	err := fake.client().AddTxtRecordWithLogin(context.Background(), ch)
+	if !IsLayoutError(err) {
+		t.Fatalf("expected a layout error, got %v", err)
+	}
+	if !IsLayoutError(fmt.Errorf("wrapped: %w", err)) {
+		t.Errorf("wrapped layout error not detected")
+	}
+
+	// other failures are not layout errors
+	fake.BrokenLayout = false
+	hc := fake.client()
+	hc.Password = "wrong"
+	if err := hc.AddTxtRecordWithLogin(context.Background(), ch); err == nil || IsLayoutError(err) {
+		t.Errorf("expected a non-layout error for bad credentials, got %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+
+	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+
+	"github.com/waldner/cert-manager-webhook-he/utils/hetest"
+)
+
+// fakeHe is the fake HE panel, with helpers returning clients for it
+type fakeHe struct {
+	*hetest.Server
+}
+
+func newFakeHe(t *testing.T, username, password string, domains ...string) *fakeHe {
+	f := &fakeHe{hetest.NewServer(t, username, password, domains...)}
+	f.TotpCode = generateTotp
+	return f
+}
+
+// dynamicDnsClient returns a dynamic-dns HeClient pointing at the fake panel
+func (f *fakeHe) dynamicDnsClient(apiKey string) *HeClient {
+	return &HeClient{
+		ApiKey: apiKey,
+		HeUrl:  f.URL + "/",
+		Method: "dynamic-dns",
+		Client: &http.Client{},
+	}
+}
+
+// client returns a login-mode HeClient pointing at the fake panel
+func (f *fakeHe) client() *HeClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &HeClient{
+		Username: f.Username,
+		Password: f.Password,
+		HeUrl:    f.URL + "/",
+		Method:   "login",
+		Client:   &http.Client{Jar: jar},
+	}
+}
+
+func challengeRequest(fqdn, zone, key string) *v1alpha1.ChallengeRequest {
+	return &v1alpha1.ChallengeRequest{
+		ResolvedFQDN: fqdn,
+		ResolvedZone: zone,
+		Key:          key,
+	}
+}
@@ -0,0 +1,377 @@
+// Package hetest provides a fake HE DNS control panel, dynamic DNS endpoint
+// and nameserver, for testing the code that talks to HE.
+package hetest
+
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Server is a minimal imitation of the dns.he.net control panel, serving just
+// enough of its HTML for the login-mode client to work against it, and of
+// dyn.dns.he.net at /nic/update.
+type Server struct {
+	t      testing.TB
+	server *httptest.Server
+	// base URL of the panel, without the trailing slash
+	URL string
+
+	Username   string
+	Password   string
+	TotpSecret string
+	// computes the code expected for TotpSecret at the given time; must be
+	// set along with TotpSecret
+	TotpCode func(secret string, t time.Time) (string, error)
+	// serve a zone list the client cannot parse, like after a redesign
+	BrokenLayout bool
+	// NS records served for the zones, HE's by default
+	delegation []string
+
+	mu       sync.Mutex
+	zones    map[string]string // domain -> zone id
+	records  map[string]*fakeRecord
+	nextId   int
+	sessions map[string]string // session cookie -> "anon", "totp" or "auth"
+	requests []string
+}
+
+type fakeRecord struct {
+	id      string
+	zoneId  string
+	name    string
+	content string
+	dynamic bool
+	ddnsKey string
+}
+
+// NewServer starts a fake panel where username and password can log in and
+// manage the given domains. It's stopped when the test ends.
+func NewServer(t testing.TB, username, password string, domains ...string) *Server {
+	f := &Server{
+		t:        t,
+		Username: username,
+		Password: password,
+		zones:    map[string]string{},
+		records:  map[string]*fakeRecord{},
+		nextId:   1000,
+		sessions: map[string]string{},
+	}
+	for i, d := range domains {
+		f.zones[d] = fmt.Sprintf("%d", 900+i)
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	f.URL = f.server.URL
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// DNSServer starts a nameserver serving the records of the fake panel, and
+// returns its address
+func (f *Server) DNSServer() string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		Handler:           dns.HandlerFunc(f.serveDns),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	f.t.Cleanup(func() { server.Shutdown() })
+	<-started
+	return pc.LocalAddr().String()
+}
+
+func (f *Server) serveDns(w dns.ResponseWriter, r *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	q := r.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(q.Name), ".")
+	for _, rec := range f.records {
+		if rec.name != name {
+			continue
+		}
+		if q.Qtype == dns.TypeTXT {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{rec.content},
+			})
+		}
+	}
+	if _, ok := f.zones[name]; ok && q.Qtype == dns.TypeNS {
+		delegation := f.delegation
+		if delegation == nil {
+			delegation = []string{"ns1.he.net.", "ns2.he.net.", "ns3.he.net.", "ns4.he.net.", "ns5.he.net."}
+		}
+		for _, ns := range delegation {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+				Ns:  ns,
+			})
+		}
+	}
+	if len(m.Answer) == 0 {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+// SetDelegation sets the NS records served for the zones
+func (f *Server) SetDelegation(nameservers ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delegation = nameservers
+}
+
+// TxtRecords returns the contents of the TXT records with the given name
+func (f *Server) TxtRecords(name string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := []string{}
+	for _, r := range f.records {
+		if r.name == name {
+			values = append(values, r.content)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// SetTxtRecord creates or replaces the record with the given id in the zone
+// of domain
+func (f *Server) SetTxtRecord(id string, domain string, name string, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records[id] = &fakeRecord{id: id, zoneId: f.zones[domain], name: name, content: content}
+}
+
+// DynamicDnsKey returns the DDNS key of the dynamic record with the given
+// name, "" if there is none
+func (f *Server) DynamicDnsKey(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.records {
+		if r.name == name && r.dynamic {
+			return r.ddnsKey
+		}
+	}
+	return ""
+}
+
+func (f *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	session := ""
+	if c, err := r.Cookie("CGISESSID"); err == nil {
+		session = c.Value
+	}
+	state := f.sessions[session]
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/" && r.Form.Get("action") == "logout":
+		delete(f.sessions, session)
+		fmt.Fprint(w, loginPage)
+
+	case r.Method == http.MethodGet && r.URL.Path == "/" && r.Form.Get("hosted_dns_zoneid") != "" && state == "auth":
+		fmt.Fprint(w, f.zonePage(r.Form.Get("hosted_dns_zoneid")))
+
+	case r.Method == http.MethodGet && r.URL.Path == "/":
+		if state == "" {
+			session = fmt.Sprintf("session-%d", len(f.sessions)+1)
+			f.sessions[session] = "anon"
+			http.SetCookie(w, &http.Cookie{Name: "CGISESSID", Value: session})
+		}
+		fmt.Fprint(w, loginPage)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/" && r.Form.Has("email") && state != "":
+		if r.Form.Get("email") != f.Username || r.Form.Get("pass") != f.Password {
+			fmt.Fprint(w, `<html><body><div id="dns_err">Incorrect</div></body></html>`)
+			return
+		}
+		if f.TotpSecret != "" {
+			f.sessions[session] = "totp"
+			fmt.Fprint(w, totpPage)
+			return
+		}
+		f.sessions[session] = "auth"
+		fmt.Fprint(w, f.zoneList())
+
+	case r.Method == http.MethodPost && r.URL.Path == "/" && r.Form.Has("tfacode") && state == "totp":
+		now := time.Now()
+		// the previous code is accepted too, to allow for clock skew
+		for _, t := range []time.Time{now, now.Add(-30 * time.Second)} {
+			code, err := f.TotpCode(f.TotpSecret, t)
+			if err != nil {
+				f.t.Fatal(err)
+			}
+			if r.Form.Get("tfacode") == code {
+				f.sessions[session] = "auth"
+				fmt.Fprint(w, f.zoneList())
+				return
+			}
+		}
+		fmt.Fprint(w, totpPage)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/index.cgi" && state == "auth":
+		f.editZone(w, r)
+
+	case r.Method == http.MethodPost && r.URL.Path == "/nic/update":
+		f.dynamicUpdate(w, r)
+
+	default:
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+	}
+}
+
+func (f *Server) editZone(w http.ResponseWriter, r *http.Request) {
+	zoneId := r.Form.Get("hosted_dns_zoneid")
+	domain := ""
+	for d, id := range f.zones {
+		if id == zoneId {
+			domain = d
+		}
+	}
+	if domain == "" {
+		http.Error(w, "unknown zone", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case r.Form.Get("hosted_dns_editrecord") == "Submit":
+		name := r.Form.Get("Name") + "." + domain
+		for _, rec := range f.records {
+			if rec.name == name && rec.content == r.Form.Get("Content") {
+				fmt.Fprint(w, `<div id="dns_err">Insert failed.  Unable to update.  That record already exists.</div>`)
+				return
+			}
+		}
+		f.nextId++
+		id := fmt.Sprintf("%d", f.nextId)
+		f.records[id] = &fakeRecord{id: id, zoneId: zoneId, name: name, content: r.Form.Get("Content"), dynamic: r.Form.Get("dynamic") == "1"}
+		fmt.Fprintf(w, `<div id="dns_status">Successfully added new record to %s</div>%s`, domain, f.zonePage(zoneId))
+
+	case r.Form.Get("hosted_dns_editrecord") == "Update":
+		rec, ok := f.records[r.Form.Get("hosted_dns_recordid")]
+		if !ok {
+			http.Error(w, "unknown record", http.StatusBadRequest)
+			return
+		}
+		rec.name = r.Form.Get("Name") + "." + domain
+		rec.content = r.Form.Get("Content")
+		rec.dynamic = r.Form.Get("dynamic") == "1"
+		fmt.Fprintf(w, `<div id="dns_status">Successfully updated record.</div>%s`, f.zonePage(zoneId))
+
+	case r.Form.Get("generate_key") == "Submit":
+		rec, ok := f.records[r.Form.Get("hosted_dns_recordid")]
+		if !ok || !rec.dynamic || r.Form.Get("Key") != r.Form.Get("Key2") {
+			http.Error(w, "cannot generate key", http.StatusBadRequest)
+			return
+		}
+		rec.ddnsKey = r.Form.Get("Key")
+		fmt.Fprintf(w, `<div id="dns_status">Successfully generated new DDNS key for %s.</div>%s`, rec.name, f.zonePage(zoneId))
+
+	case r.Form.Get("hosted_dns_delrecord") == "1":
+		if _, ok := f.records[r.Form.Get("hosted_dns_recordid")]; !ok {
+			http.Error(w, "unknown record", http.StatusBadRequest)
+			return
+		}
+		delete(f.records, r.Form.Get("hosted_dns_recordid"))
+		fmt.Fprint(w, `<div id="dns_status">Successfully removed record.</div>`)
+
+	default:
+		http.Error(w, "unexpected zone edit", http.StatusBadRequest)
+	}
+}
+
+// dynamicUpdate imitates dyn.dns.he.net, which answers like dyndns2
+func (f *Server) dynamicUpdate(w http.ResponseWriter, r *http.Request) {
+	for _, rec := range f.records {
+		if rec.name != r.Form.Get("hostname") || !rec.dynamic {
+			continue
+		}
+		if rec.ddnsKey == "" || rec.ddnsKey != r.Form.Get("password") {
+			fmt.Fprint(w, "badauth")
+			return
+		}
+		if rec.content == r.Form.Get("txt") {
+			fmt.Fprintf(w, "nochg %s", r.Form.Get("txt"))
+			return
+		}
+		rec.content = r.Form.Get("txt")
+		fmt.Fprintf(w, "good %s", r.Form.Get("txt"))
+		return
+	}
+	fmt.Fprint(w, "nohost")
+}
+
+func (f *Server) zoneList() string {
+	if f.BrokenLayout {
+		return fmt.Sprintf(`<html><body><p>Logged in as %s</p><div class="zones"><ul><li>example.com</li></ul></div></body></html>`, html.EscapeString(f.Username))
+	}
+	var b strings.Builder
+	b.WriteString(`<html><body><table id="domains_table"><tbody>`)
+	for d, id := range f.zones {
+		fmt.Fprintf(&b, `<tr><td></td><td><img alt="edit" onclick="javascript:document.location.href='?hosted_dns_zoneid=%s&menu=edit_zone&hosted_dns_editzone'"/></td><td><span>%s</span></td></tr>`, id, d)
+	}
+	b.WriteString(`</tbody></table></body></html>`)
+	return b.String()
+}
+
+func (f *Server) zonePage(zoneId string) string {
+	domain := ""
+	for d, id := range f.zones {
+		if id == zoneId {
+			domain = d
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `<html><body><h3>Managing zone: %s</h3><div id="dns_main_content"><table><tbody>`, domain)
+	for _, r := range f.records {
+		if r.zoneId != zoneId {
+			continue
+		}
+		quoted := html.EscapeString(`"` + r.content + `"`)
+		fmt.Fprintf(&b, `<tr class="dns_tr" id="%s"><td class="hidden">%s</td><td class="hidden">%s</td><td class="dns_view">%s</td>`, r.id, zoneId, r.id, r.name)
+		fmt.Fprintf(&b, `<td align="center"><span class="rrlabel TXT" data="TXT" alt="TXT">TXT</span></td><td align="left">7200</td><td align="center">-</td>`)
+		dynamic := 0
+		if r.dynamic {
+			dynamic = 1
+		}
+		fmt.Fprintf(&b, `<td align="left" data="%s">%s</td><td class="hidden">%d</td><td></td>`, quoted, quoted, dynamic)
+		fmt.Fprintf(&b, `<td align="center" class="dns_delete" onclick="event.cancelBubble=true;deleteRecord('%s','%s','TXT')"></td></tr>`, r.id, r.name)
+	}
+	b.WriteString(`</tbody></table></div></body></html>`)
+	return b.String()
+}
+
+const loginPage = `<html><body><form name="login" method="post" action="/">
+<input type="text" name="email"/><input type="password" name="pass"/><input type="submit" name="submit" value="Login!"/>
+</form></body></html>`
+
+const totpPage = `<html><body><form name="tfa" method="post" action="/">
+<input type="text" name="tfacode"/><input type="submit" name="submit" value="Submit"/>
+</form></body></html>`
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-logr/logr/funcr"
+	"k8s.io/klog/v2"
+)
+
+func TestContextLogger(t *testing.T) {
+	var mu sync.Mutex
+	lines := []string{}
+	logger := funcr.New(func(prefix, args string) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, args)
+	}, funcr.Options{})
+	ctx := klog.NewContext(context.Background(), logger.WithValues("challenge", "uid-1234"))
+
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+	if err := fake.client().AddTxtRecordWithLogin(ctx, ch); err != nil {
+		t.Fatalf("AddTxtRecordWithLogin: %v", err)
+	}
+	if err := fake.client().RemoveTxtRecordWithLogin(ctx, ch); err != nil {
+		t.Fatalf("RemoveTxtRecordWithLogin: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) == 0 {
+		t.Fatalf("nothing was logged through the context logger")
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"challenge"="uid-1234"`) {
+			t.Errorf("log line without the challenge: %v", line)
+		}
+	}
+}
+
+func TestClientLogRedactsCredentials(t *testing.T) {
+	var lines []string
+	logger := funcr.NewJSON(func(obj string) {
+		lines = append(lines, obj)
+	}, funcr.Options{})
+
+	hc := &HeClient{
+		Username:   "user",
+		Password:   "secret-password",
+		TotpSecret: "JBSWY3DPEHPK3PXP",
+		ApiKey:     "secret-api-key",
+		HeUrl:      "https://dns.he.net/",
+		Method:     "login",
+		TTL:        300,
+	}
+	logger.Info("Generated config", "heClient", hc)
+	lines = append(lines, hc.String())
+
+	for _, line := range lines {
+		for _, secret := range []string{hc.Password, hc.TotpSecret, hc.ApiKey} {
+			if strings.Contains(line, secret) {
+				t.Errorf("credential %q logged: %v", secret, line)
+			}
+		}
+		if !strings.Contains(line, "https://dns.he.net/") || !strings.Contains(line, "login") {
+			t.Errorf("method or URL missing: %v", line)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the HTTP steps of the interactions with HE, as used in the metrics. The
+// zone list is the page returned by the login (or TOTP) step.
+const (
+	stepInitialPage = "initial_page"
+	stepLogin       = "login"
+	stepTotp        = "totp"
+	stepZonePage    = "zone_page"
+	stepRecordPost  = "index_cgi_post"
+	stepNicUpdate   = "nic_update"
+	stepLogout      = "logout"
+)
+
+var (
+	heRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "he_webhook",
+		Name:      "he_request_duration_seconds",
+		Help:      "Duration of the HTTP requests to HE, by step and status code (\"error\" if there was no response).",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"step", "code"})
+
+	heLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "he_webhook",
+		Name:      "logins_total",
+		Help:      "Logins to the HE control panel, by result.",
+	}, []string{"result"})
+
+	dynamicDnsResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "he_webhook",
+		Name:      "dynamic_dns_results_total",
+		Help:      "Answers of the dynamic DNS service, by result code.",
+	}, []string{"code"})
+
+	heOpenSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "he_webhook",
+		Name:      "open_sessions",
+		Help:      "Sessions currently logged in to the HE control panel.",
+	})
+)
+
+// RegisterMetrics registers the metrics about the interactions with HE
+func RegisterMetrics(r prometheus.Registerer) {
+	r.MustRegister(heRequestDuration, heLogins, dynamicDnsResults, heOpenSessions)
+}
+
+// get does a GET request to HE, recording its duration as the given step
+func (hc *HeClient) get(ctx context.Context, step string, u string) (*http.Response, error) {
+	response, err := hc.observe(ctx, step, func(ctx context.Context) (*http.Response, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		return hc.Client.Do(request)
+	})
+	hc.capture(step, http.MethodGet, u, nil, response)
+	return response, err
+}
+
+// postForm does a POST request to HE, recording its duration as the given step
+func (hc *HeClient) postForm(ctx context.Context, step string, u string, data url.Values) (*http.Response, error) {
+	response, err := hc.observe(ctx, step, func(ctx context.Context) (*http.Response, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(data.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return hc.Client.Do(request)
+	})
+	hc.capture(step, http.MethodPost, u, data, response)
+	return response, err
+}
+
+// observe runs a request to HE in its own span, and records its duration
+func (hc *HeClient) observe(ctx context.Context, step string, request func(context.Context) (*http.Response, error)) (*http.Response, error) {
+	ctx, span := tracer.Start(ctx, "he."+step, trace.WithAttributes(attribute.String("he.step", step)))
+	defer span.End()
+
+	start := time.Now()
+	response, err := request(ctx)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(response.StatusCode)
+		span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
+	} else {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	heRequestDuration.WithLabelValues(step, code).Observe(time.Since(start).Seconds())
+	return response, err
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+
+	logins := testutil.ToFloat64(heLogins.WithLabelValues("success"))
+	failedLogins := testutil.ToFloat64(heLogins.WithLabelValues("invalid_credentials"))
+
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+	if err := fake.client().AddTxtRecordWithLogin(context.Background(), ch); err != nil {
+		t.Fatalf("AddTxtRecordWithLogin: %v", err)
+	}
+	hc := fake.client()
+	hc.Password = "wrong"
+	if err := hc.AddTxtRecordWithLogin(context.Background(), ch); err == nil {
+		t.Fatalf("expected a login failure")
+	}
+
+	if got := testutil.ToFloat64(heLogins.WithLabelValues("success")) - logins; got != 1 {
+		t.Errorf("successful logins = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(heLogins.WithLabelValues("invalid_credentials")) - failedLogins; got != 1 {
+		t.Errorf("failed logins = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(heOpenSessions); got != 0 {
+		t.Errorf("open sessions = %v, want 0 after logout", got)
+	}
+	// one series per step and code
+	if got := testutil.CollectAndCount(heRequestDuration); got < 5 {
+		t.Errorf("request durations recorded for %v steps, want at least 5", got)
+	}
+
+	results := testutil.ToFloat64(dynamicDnsResults.WithLabelValues("nohost"))
+	if err := fake.dynamicDnsClient("key").AddTxtRecordWithDynamicDns(context.Background(), ch); err == nil {
+		t.Fatalf("expected a nohost error")
+	}
+	if got := testutil.ToFloat64(dynamicDnsResults.WithLabelValues("nohost")) - results; got != 1 {
+		t.Errorf("nohost results = %v, want 1", got)
+	}
+}
@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// value given to dynamic-dns TXT records when they're not in use
+const placeholderTxt = "UNUSED"
+
+// length and alphabet of the generated DDNS keys
+const (
+	ddnsKeyLength   = 32
+	ddnsKeyAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// GenerateDynamicDnsKey returns a new random DDNS key
+func GenerateDynamicDnsKey() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(ddnsKeyAlphabet)))
+	for i := 0; i < ddnsKeyLength; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("cannot generate key: %v", err)
+		}
+		b.WriteByte(ddnsKeyAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// ProvisionDynamicDns prepares a record for the dynamic-dns method, using the
+// login credentials: it makes sure there is a TXT record named fqdn in zone
+// with dynamic DNS enabled (creating it if needed), and sets its DDNS key. If
+// key is empty, a new random one is generated. It returns the key that was
+// set.
+func (hc *HeClient) ProvisionDynamicDns(ctx context.Context, fqdn string, zone string, key string) (_ string, err error) {
+
+	logger := klog.FromContext(ctx)
+	defer func() { hc.saveSnapshot(ctx, err) }()
+	fqdn, rn, domain, err := splitName(fqdn, zone)
+	if err != nil {
+		return "", err
+	}
+
+	if key == "" {
+		if key, err = GenerateDynamicDnsKey(); err != nil {
+			return "", err
+		}
+	}
+
+	logger.Info("ProvisionDynamicDns", "fqdn", fqdn, "domain", domain)
+
+	body, err := hc.doLogin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer hc.doLogout(ctx)
+
+	page, domainData, err := hc.openZone(ctx, body, domain)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := findTxtRecord(logger, page, fqdn)
+	if err != nil {
+		return "", err
+	}
+
+	// an existing record is kept (with its value), just making sure dynamic DNS is enabled
+	recordId, value := "", hc.placeholder()
+	if record != nil {
+		recordId, value = record.id, record.value
+	}
+	if err := hc.saveDynamicRecord(ctx, domainData.hostedDnsZoneId, recordId, rn, domain, value); err != nil {
+		return "", err
+	}
+
+	if record == nil {
+		// find out the id of the new record
+		if page, domainData, err = hc.openZone(ctx, body, domain); err != nil {
+			return "", err
+		}
+		if record, err = findTxtRecord(logger, page, fqdn); err != nil {
+			return "", err
+		}
+		if record == nil {
+			return "", fmt.Errorf("cannot find the new record %v in zone", fqdn)
+		}
+	}
+
+	if err := hc.setDynamicDnsKey(ctx, domainData.hostedDnsZoneId, record.id, fqdn, domain, key); err != nil {
+		return "", err
+	}
+
+	logger.Info("Successfully provisioned record for dynamic DNS", "fqdn", fqdn)
+	return key, nil
+}
+
+// RotateDynamicDnsKey sets a new DDNS key for an existing dynamic-dns record,
+// using the login credentials. It returns the current value of the record,
+// so that the new key can be checked by setting it again.
+func (hc *HeClient) RotateDynamicDnsKey(ctx context.Context, fqdn string, zone string, key string) (_ string, err error) {
+
+	logger := klog.FromContext(ctx)
+	defer func() { hc.saveSnapshot(ctx, err) }()
+	fqdn, _, domain, err := splitName(fqdn, zone)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Info("RotateDynamicDnsKey", "fqdn", fqdn, "domain", domain)
+
+	body, err := hc.doLogin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer hc.doLogout(ctx)
+
+	page, domainData, err := hc.openZone(ctx, body, domain)
+	if err != nil {
+		return "", err
+	}
+
+	record, err := findTxtRecord(logger, page, fqdn)
+	if err != nil {
+		return "", err
+	}
+	if record == nil {
+		return "", fmt.Errorf("there is no TXT record named %v in zone", fqdn)
+	}
+
+	if err := hc.setDynamicDnsKey(ctx, domainData.hostedDnsZoneId, record.id, fqdn, domain, key); err != nil {
+		return "", err
+	}
+	return record.value, nil
+}
+
+// splitName returns the fqdn (without trailing dot), the record name relative
+// to zone and the domain
+func splitName(fqdn string, zone string) (string, string, string, error) {
+	domain := strings.TrimSuffix(zone, ".")
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if !strings.HasSuffix(fqdn, "."+domain) {
+		return "", "", "", fmt.Errorf("%v is not a name inside zone %v", fqdn, domain)
+	}
+	return fqdn, strings.TrimSuffix(fqdn, "."+domain), domain, nil
+}
+
+// findTxtRecord returns the TXT record with the given name in a zone page,
+// or nil if there is none. Dynamic-dns records hold a single value, so more
+// than one record is an error.
+func findTxtRecord(logger klog.Logger, page string, fqdn string) (*txtRecord, error) {
+	records, err := parseTxtRecords(logger, page)
+	if err != nil {
+		return nil, err
+	}
+	var found *txtRecord
+	for i, r := range records {
+		if r.name != fqdn {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("there are several TXT records named %v, dynamic DNS needs exactly one", fqdn)
+		}
+		found = &records[i]
+	}
+	return found, nil
+}
+
+// saveDynamicRecord creates (if recordId is empty) or updates a TXT record with
+// dynamic DNS enabled
+func (hc *HeClient) saveDynamicRecord(ctx context.Context, zoneId string, recordId string, rn string, domain string, value string) (err error) {
+
+	logger := klog.FromContext(ctx)
+	action, auditAction := "Submit", AuditCreate
+	if recordId != "" {
+		action, auditAction = "Update", AuditUpdate
+	}
+	defer func() { hc.audit(auditAction, domain, rn+"."+domain, recordId, err) }()
+
+	logger.Info("Saving the TXT record with dynamic DNS enabled", "rn", rn, "domain", domain, "recordId", recordId)
+
+	postData := url.Values{}
+	postData.Set("account", "")
+	postData.Set("menu", "edit_zone")
+	postData.Set("Type", "TXT")
+	postData.Set("hosted_dns_zoneid", zoneId)
+	postData.Set("hosted_dns_recordid", recordId)
+	postData.Set("hosted_dns_editzone", "1")
+	postData.Set("Priority", "")
+	postData.Set("Name", rn)
+	postData.Set("Content", value)
+	postData.Set("TTL", strconv.Itoa(hc.ttl()))
+	postData.Set("dynamic", "1")
+	postData.Set("hosted_dns_editrecord", action)
+
+	response, err := hc.postForm(ctx, stepRecordPost, hc.HeUrl+"index.cgi", postData)
+	if err != nil {
+		return fmt.Errorf("error saving record: %v", err)
+	}
+
+	body, err := readBody(response)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("got invalid status code %v", response.StatusCode)
+	}
+
+	msg1 := fmt.Sprintf(">Successfully added new record to %v<", domain)
+	msg2 := ">Successfully updated record."
+	if !(strings.Contains(body, msg1) || strings.Contains(body, msg2)) {
+		return layoutErrorf("cannot find the expected save message in page")
+	}
+	return nil
+}
+
+// setDynamicDnsKey sets the DDNS key of a record, like the "generate a DDNS
+// key" dialog of the control panel does
+func (hc *HeClient) setDynamicDnsKey(ctx context.Context, zoneId string, recordId string, fqdn string, domain string, key string) (err error) {
+
+	logger := klog.FromContext(ctx)
+	defer func() { hc.audit(AuditSetKey, domain, fqdn, recordId, err) }()
+	logger.Info("Setting the DDNS key", "fqdn", fqdn, "recordId", recordId)
+
+	postData := url.Values{}
+	postData.Set("menu", "edit_zone")
+	postData.Set("hosted_dns_zoneid", zoneId)
+	postData.Set("hosted_dns_recordid", recordId)
+	postData.Set("hosted_dns_editzone", "1")
+	postData.Set("Name", fqdn)
+	postData.Set("Key", key)
+	postData.Set("Key2", key)
+	postData.Set("generate_key", "Submit")
+
+	response, err := hc.postForm(ctx, stepRecordPost, hc.HeUrl+"index.cgi", postData)
+	if err != nil {
+		return fmt.Errorf("error setting DDNS key: %v", err)
+	}
+
+	body, err := readBody(response)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("got invalid status code %v", response.StatusCode)
+	}
+
+	if !strings.Contains(body, ">Successfully generated new DDNS key") {
+		return layoutErrorf("cannot find the key generation message in page")
+	}
+	return nil
+}
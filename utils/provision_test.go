@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProvisionDynamicDns(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+
+	key, err := fake.client().ProvisionDynamicDns(context.Background(), "_acme-challenge.www.example.com.", "example.com.", "")
+	if err != nil {
+		t.Fatalf("ProvisionDynamicDns: %v", err)
+	}
+	if len(key) != ddnsKeyLength {
+		t.Errorf("unexpected generated key %q", key)
+	}
+	if got := fake.TxtRecords("_acme-challenge.www.example.com"); !reflect.DeepEqual(got, []string{placeholderTxt}) {
+		t.Fatalf("unexpected records after provisioning: %v", got)
+	}
+
+	// the key works for dynamic-dns
+	ch := challengeRequest("_acme-challenge.www.example.com.", "example.com.", "challenge-key")
+	if err := fake.dynamicDnsClient(key).AddTxtRecordWithDynamicDns(context.Background(), ch); err != nil {
+		t.Fatalf("AddTxtRecordWithDynamicDns with provisioned key: %v", err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.www.example.com"); !reflect.DeepEqual(got, []string{"challenge-key"}) {
+		t.Fatalf("unexpected records after Present: %v", got)
+	}
+
+	// provisioning again reuses the record, keeping its value, and sets the given key
+	key2, err := fake.client().ProvisionDynamicDns(context.Background(), "_acme-challenge.www.example.com", "example.com", "my-own-key")
+	if err != nil || key2 != "my-own-key" {
+		t.Fatalf("ProvisionDynamicDns with key = %q, %v", key2, err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.www.example.com"); !reflect.DeepEqual(got, []string{"challenge-key"}) {
+		t.Fatalf("unexpected records after reprovisioning: %v", got)
+	}
+	if err := fake.dynamicDnsClient(key).RemoveTxtRecordWithDynamicDns(context.Background(), ch); err == nil {
+		t.Errorf("the old key should not work anymore")
+	}
+	if err := fake.dynamicDnsClient("my-own-key").RemoveTxtRecordWithDynamicDns(context.Background(), ch); err != nil {
+		t.Errorf("RemoveTxtRecordWithDynamicDns with new key: %v", err)
+	}
+
+	if _, err := fake.client().ProvisionDynamicDns(context.Background(), "_acme-challenge.example.org", "example.com", ""); err == nil || !strings.Contains(err.Error(), "not a name inside zone") {
+		t.Errorf("expected an error for a name outside the zone, got %v", err)
+	}
+}
+
+func TestRotateDynamicDnsKey(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+
+	if _, err := fake.client().RotateDynamicDnsKey(context.Background(), "_acme-challenge.example.com", "example.com", "new-key"); err == nil {
+		t.Errorf("expected an error for a missing record")
+	}
+
+	if _, err := fake.client().ProvisionDynamicDns(context.Background(), "_acme-challenge.example.com", "example.com", "old-key"); err != nil {
+		t.Fatalf("ProvisionDynamicDns: %v", err)
+	}
+	if err := fake.dynamicDnsClient("old-key").UpdateDynamicDns(context.Background(), "_acme-challenge.example.com", "in-use"); err != nil {
+		t.Fatalf("UpdateDynamicDns: %v", err)
+	}
+
+	value, err := fake.client().RotateDynamicDnsKey(context.Background(), "_acme-challenge.example.com.", "example.com.", "new-key")
+	if err != nil {
+		t.Fatalf("RotateDynamicDnsKey: %v", err)
+	}
+	if value != "in-use" {
+		t.Errorf("RotateDynamicDnsKey returned value %q, want %q", value, "in-use")
+	}
+
+	// setting the same value again with the new key is harmless
+	if err := fake.dynamicDnsClient("new-key").UpdateDynamicDns(context.Background(), "_acme-challenge.example.com", value); err != nil {
+		t.Errorf("UpdateDynamicDns with the new key: %v", err)
+	}
+	if err := fake.dynamicDnsClient("old-key").UpdateDynamicDns(context.Background(), "_acme-challenge.example.com", value); err == nil {
+		t.Errorf("the old key should not work anymore")
+	}
+	if got := fake.TxtRecords("_acme-challenge.example.com"); !reflect.DeepEqual(got, []string{"in-use"}) {
+		t.Errorf("unexpected records after rotation: %v", got)
+	}
+}
@@ -0,0 +1,209 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// how much of a page is kept in a snapshot
+const maxSnapshotBody = 1 << 20
+
+// what scrubbed values are replaced with
+const redacted = "[REDACTED]"
+
+// form fields holding credentials or keys
+var sensitiveFields = map[string]bool{
+	"email":    true,
+	"pass":     true,
+	"password": true,
+	"tfacode":  true,
+	"Key":      true,
+	"Key2":     true,
+}
+
+// Snapshot is a request to HE and the page it got back, saved when the page
+// didn't look as expected, so that changes in the control panel can be
+// reported. Credentials are scrubbed, and no headers (so no cookies) are
+// kept.
+type Snapshot struct {
+	Time        time.Time           `json:"time"`
+	Error       string              `json:"error"`
+	Step        string              `json:"step"`
+	Method      string              `json:"method"`
+	URL         string              `json:"url"`
+	Form        map[string][]string `json:"form,omitempty"`
+	Status      int                 `json:"status"`
+	ContentType string              `json:"contentType"`
+	Body        string              `json:"body"`
+}
+
+// SnapshotStore keeps the latest snapshots in memory
+type SnapshotStore struct {
+	mu        sync.Mutex
+	limit     int
+	snapshots []Snapshot
+}
+
+// NewSnapshotStore returns a store keeping up to limit snapshots
+func NewSnapshotStore(limit int) *SnapshotStore {
+	return &SnapshotStore{limit: limit}
+}
+
+// SetLimit changes how many snapshots are kept, dropping the oldest ones if
+// needed
+func (s *SnapshotStore) SetLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	s.trim()
+}
+
+// Add saves a snapshot, dropping the oldest one if the store is full
+func (s *SnapshotStore) Add(snapshot Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots = append(s.snapshots, snapshot)
+	s.trim()
+}
+
+func (s *SnapshotStore) trim() {
+	if over := len(s.snapshots) - s.limit; over > 0 {
+		s.snapshots = append([]Snapshot(nil), s.snapshots[over:]...)
+	}
+}
+
+// List returns the snapshots, newest first
+func (s *SnapshotStore) List() []Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Snapshot, 0, len(s.snapshots))
+	for i := len(s.snapshots) - 1; i >= 0; i-- {
+		list = append(list, s.snapshots[i])
+	}
+	return list
+}
+
+// ServeHTTP lists the snapshots as JSON, newest first. With ?page=N, it
+// serves just the page of the Nth one, for viewing or diffing.
+func (s *SnapshotStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	list := s.List()
+
+	if p := r.URL.Query().Get("page"); p != "" {
+		i, err := strconv.Atoi(p)
+		if err != nil || i < 0 || i >= len(list) {
+			http.Error(w, "no such snapshot", http.StatusNotFound)
+			return
+		}
+		// served as text, so that the page is not rendered by the browser
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, list[i].Body)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		klog.ErrorS(err, "Error writing snapshots")
+	}
+}
+
+// exchange is the last request made to HE, kept for a snapshot
+type exchange struct {
+	step   string
+	method string
+	url    string
+	form   url.Values
+	status int
+	ctype  string
+	body   bytes.Buffer
+}
+
+// capture remembers a request and its response, if snapshots are enabled.
+// The body is copied as the caller reads it. The logout is skipped, as it
+// happens (deferred) after the page that failed.
+func (hc *HeClient) capture(step string, method string, u string, form url.Values, response *http.Response) {
+	if hc.Snapshots == nil || step == stepLogout {
+		return
+	}
+	hc.last = &exchange{step: step, method: method, url: u, form: form}
+	if response == nil {
+		return
+	}
+	hc.last.status = response.StatusCode
+	hc.last.ctype = response.Header.Get("Content-Type")
+	response.Body = &capturingBody{ReadCloser: response.Body, buf: &hc.last.body}
+}
+
+type capturingBody struct {
+	io.ReadCloser
+	buf *bytes.Buffer
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if room := maxSnapshotBody - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+// saveSnapshot saves the last exchange if err says the page didn't look as
+// expected
+func (hc *HeClient) saveSnapshot(ctx context.Context, err error) {
+	if hc.Snapshots == nil || hc.last == nil || !IsLayoutError(err) {
+		return
+	}
+	last := hc.last
+
+	// the credentials could be echoed anywhere in the page
+	secrets := []string{hc.Username, hc.Password, hc.ApiKey, hc.TotpSecret}
+	for name, values := range last.form {
+		if sensitiveFields[name] {
+			secrets = append(secrets, values...)
+		}
+	}
+	scrub := func(s string) string {
+		for _, secret := range secrets {
+			if secret == "" {
+				continue
+			}
+			// as it is, and as it would appear in HTML or in a URL
+			for _, encoded := range []string{secret, html.EscapeString(secret), url.QueryEscape(secret)} {
+				s = strings.ReplaceAll(s, encoded, redacted)
+			}
+		}
+		return s
+	}
+	form := map[string][]string{}
+	for name, values := range last.form {
+		for _, v := range values {
+			if sensitiveFields[name] {
+				v = redacted
+			}
+			form[name] = append(form[name], scrub(v))
+		}
+	}
+
+	hc.Snapshots.Add(Snapshot{
+		Time:        time.Now().UTC(),
+		Error:       err.Error(),
+		Step:        last.step,
+		Method:      last.method,
+		URL:         scrub(last.url),
+		Form:        form,
+		Status:      last.status,
+		ContentType: last.ctype,
+		Body:        scrub(last.body.String()),
+	})
+	klog.FromContext(ctx).Info("Saved a snapshot of the unexpected page", "step", last.step)
+}
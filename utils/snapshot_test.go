@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	fake := newFakeHe(t, "someone@example.org", "secret-password", "example.com")
+	fake.BrokenLayout = true
+	store := NewSnapshotStore(2)
+
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+
+	// disabled by default
+	if err := fake.client().AddTxtRecordWithLogin(context.Background(), ch); !IsLayoutError(err) {
+		t.Fatalf("expected a layout error, got %v", err)
+	}
+	if len(store.List()) != 0 {
+		t.Fatalf("snapshot saved without a store")
+	}
+
+	for i := 0; i < 3; i++ {
+		hc := fake.client()
+		hc.Snapshots = store
+		if err := hc.AddTxtRecordWithLogin(context.Background(), ch); !IsLayoutError(err) {
+			t.Fatalf("expected a layout error, got %v", err)
+		}
+	}
+	list := store.List()
+	if len(list) != 2 {
+		t.Fatalf("got %v snapshots, want the last 2", len(list))
+	}
+
+	s := list[0]
+	if s.Step != stepLogin || s.Method != "POST" || s.Status != 200 || !strings.Contains(s.Error, "cannot find") {
+		t.Errorf("unexpected snapshot: %+v", s)
+	}
+	if !strings.Contains(s.Body, `class="zones"`) {
+		t.Errorf("snapshot without the page: %v", s.Body)
+	}
+	if s.Form["pass"][0] != redacted || s.Form["email"][0] != redacted || s.Form["submit"][0] != "Login!" {
+		t.Errorf("form not scrubbed as expected: %v", s.Form)
+	}
+
+	// nothing secret is served
+	recorder := httptest.NewRecorder()
+	store.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/snapshots", nil))
+	served, _ := io.ReadAll(recorder.Body)
+	for _, secret := range []string{"someone@example.org", "secret-password", "Cookie", "session"} {
+		if strings.Contains(string(served), secret) {
+			t.Errorf("served snapshots contain %q", secret)
+		}
+	}
+	decoded := []Snapshot{}
+	if err := json.Unmarshal(served, &decoded); err != nil || len(decoded) != 2 {
+		t.Errorf("cannot decode served snapshots: %v", err)
+	}
+
+	recorder = httptest.NewRecorder()
+	store.ServeHTTP(recorder, httptest.NewRequest("GET", "/debug/snapshots?page=0", nil))
+	if page, _ := io.ReadAll(recorder.Body); string(page) != s.Body || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("unexpected page: %s", page)
+	}
+
+	store.SetLimit(0)
+	if len(store.List()) != 0 {
+		t.Errorf("snapshots kept after disabling them")
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateTotp(t *testing.T) {
+	// RFC 6238 appendix B test vectors for the SHA1 seed "12345678901234567890",
+	// truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := generateTotp(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("generateTotp at %d = %q, want %q", tt.unix, got, tt.want)
+		}
+	}
+
+	// the grouped, lowercase form shown by authenticator apps is accepted too
+	got, err := generateTotp("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	if err != nil || got != "287082" {
+		t.Errorf("generateTotp with formatted secret = %q, %v", got, err)
+	}
+
+	if _, err := generateTotp("not base32!", time.Now()); err == nil {
+		t.Errorf("expected an error for an invalid secret")
+	}
+}
+
+func TestLoginWithTotp(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	fake.TotpSecret = "JBSWY3DPEHPK3PXP"
+
+	hc := fake.client()
+	hc.TotpSecret = fake.TotpSecret
+
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+
+	if err := hc.AddTxtRecordWithLogin(context.Background(), ch); err != nil {
+		t.Fatalf("AddTxtRecordWithLogin: %v", err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.example.com"); !reflect.DeepEqual(got, []string{"challenge-key"}) {
+		t.Fatalf("unexpected records after Present: %v", got)
+	}
+
+	if err := hc.RemoveTxtRecordWithLogin(context.Background(), ch); err != nil {
+		t.Fatalf("RemoveTxtRecordWithLogin: %v", err)
+	}
+	if got := fake.TxtRecords("_acme-challenge.example.com"); len(got) != 0 {
+		t.Fatalf("unexpected records after CleanUp: %v", got)
+	}
+}
+
+func TestLoginWithTotpErrors(t *testing.T) {
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	fake.TotpSecret = "JBSWY3DPEHPK3PXP"
+
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+
+	hc := fake.client()
+	err := hc.AddTxtRecordWithLogin(context.Background(), ch)
+	if err == nil || !strings.Contains(err.Error(), "no TOTP secret") {
+		t.Errorf("expected missing TOTP secret error, got %v", err)
+	}
+
+	hc = fake.client()
+	hc.TotpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	err = hc.AddTxtRecordWithLogin(context.Background(), ch)
+	if err == nil || !strings.Contains(err.Error(), "two-factor authentication failed") {
+		t.Errorf("expected two-factor failure, got %v", err)
+	}
+
+	if got := fake.TxtRecords("_acme-challenge.example.com"); len(got) != 0 {
+		t.Errorf("no record should have been created: %v", got)
+	}
+}
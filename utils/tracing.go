@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+)
+
+// TracerName is the instrumentation name of the spans created by the webhook
+const TracerName = "github.com/waldner/cert-manager-webhook-he"
+
+// the tracer is looked up through the global provider, so that it follows a
+// provider installed after this package is initialized
+var tracer = otel.Tracer(TracerName + "/utils")
+
+// NewHttpClient returns an http.Client for talking to HE whose requests are
+// traced. jar may be nil (for dynamic-dns, which doesn't need cookies).
+func NewHttpClient(timeout time.Duration, jar http.CookieJar) *http.Client {
+	return &http.Client{
+		Jar:       jar,
+		Timeout:   timeout,
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+	}
+}
+
+// RedactRecordName hides the part of a record name that identifies the
+// domain being validated, so it can be put in traces: the leading
+// _acme-challenge label (if any) is kept, the rest is replaced by a short
+// hash that is stable across the spans of a challenge.
+func RedactRecordName(fqdn string) string {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	prefix := ""
+	if rest, ok := strings.CutPrefix(fqdn, "_acme-challenge."); ok {
+		prefix, fqdn = "_acme-challenge.", rest
+	}
+	sum := sha256.Sum256([]byte(strings.ToLower(fqdn)))
+	return prefix + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	// the global provider and propagator are set back for the other tests
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+		provider.Shutdown(context.Background())
+	})
+
+	fake := newFakeHe(t, "user", "pass", "example.com")
+	hc := fake.client()
+	hc.Client = NewHttpClient(10*time.Second, hc.Client.Jar)
+
+	ctx, root := provider.Tracer("test").Start(context.Background(), "present")
+	ch := challengeRequest("_acme-challenge.example.com.", "example.com.", "challenge-key")
+	if err := hc.AddTxtRecordWithLogin(ctx, ch); err != nil {
+		t.Fatalf("AddTxtRecordWithLogin: %v", err)
+	}
+	root.End()
+
+	spans := exporter.GetSpans()
+	byId := map[string]tracetest.SpanStub{}
+	for _, s := range spans {
+		byId[s.SpanContext.SpanID().String()] = s
+	}
+
+	steps := []string{}
+	for _, s := range spans {
+		if s.SpanContext.TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("span %v is not in the challenge trace", s.Name)
+		}
+		if !strings.HasPrefix(s.Name, "he.") {
+			continue
+		}
+		steps = append(steps, s.Name)
+		if s.Parent.SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("span %v: parent is not the challenge span", s.Name)
+		}
+	}
+	want := []string{"he." + stepInitialPage, "he." + stepLogin, "he." + stepRecordPost, "he." + stepLogout}
+	if strings.Join(steps, ",") != strings.Join(want, ",") {
+		t.Errorf("HE step spans = %v, want %v", steps, want)
+	}
+
+	// the instrumented transport adds an HTTP span under each step
+	httpSpans := 0
+	for _, s := range spans {
+		if parent, ok := byId[s.Parent.SpanID().String()]; ok && strings.HasPrefix(parent.Name, "he.") {
+			httpSpans++
+		}
+	}
+	if httpSpans != len(want) {
+		t.Errorf("got %v HTTP spans under the HE steps, want %v", httpSpans, len(want))
+	}
+}
+
+func TestRedactRecordName(t *testing.T) {
+	redacted := RedactRecordName("_acme-challenge.www.example.com.")
+	if !strings.HasPrefix(redacted, "_acme-challenge.") || strings.Contains(redacted, "example") {
+		t.Errorf("RedactRecordName = %v, want the domain hidden", redacted)
+	}
+	if RedactRecordName("_acme-challenge.WWW.example.com") != redacted {
+		t.Errorf("RedactRecordName is not stable across case and trailing dot")
+	}
+	if RedactRecordName("_acme-challenge.other.example.com") == redacted {
+		t.Errorf("different names redact to the same value")
+	}
+}
@@ -1,12 +1,15 @@
 package utils
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antchfx/htmlquery"
 	"github.com/cert-manager/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
@@ -22,35 +25,90 @@ type domainData struct {
 }
 
 type HeClient struct {
-	Username string
-	Password string
-	ApiKey   string
-	HeUrl    string
-	Method   string
-	Client   *http.Client
+	Username   string
+	Password   string
+	TotpSecret string
+	ApiKey     string
+	HeUrl      string
+	Method     string
+	TTL        int
+	Client     *http.Client
+
+	// nameservers asked for the current value of a dynamic-dns record
+	// before resetting it; if empty, it's reset without checking
+	Nameservers []string
+	// value given to dynamic-dns records when they're reset
+	Placeholder string
+
+	// if set, every change made to a DNS record is recorded here
+	Audit AuditLog
+	// on whose behalf the changes are made, for the audit log
+	AuditSubject AuditSubject
+
+	// if set, the pages that don't look as expected are saved here
+	Snapshots *SnapshotStore
+	// the last request, for snapshots
+	last *exchange
 }
 
-func (hc *HeClient) AddTxtRecordWithLogin(ch *v1alpha1.ChallengeRequest) error {
+// MarshalLog keeps the credentials out of the logs
+func (hc *HeClient) MarshalLog() interface{} {
+	return struct {
+		Username    string   `json:"username"`
+		Password    string   `json:"password,omitempty"`
+		TotpSecret  string   `json:"totpSecret,omitempty"`
+		ApiKey      string   `json:"apiKey,omitempty"`
+		HeUrl       string   `json:"heUrl"`
+		Method      string   `json:"method"`
+		TTL         int      `json:"ttl"`
+		Nameservers []string `json:"nameservers,omitempty"`
+	}{
+		Username:    hc.Username,
+		Password:    redact(hc.Password),
+		TotpSecret:  redact(hc.TotpSecret),
+		ApiKey:      redact(hc.ApiKey),
+		HeUrl:       hc.HeUrl,
+		Method:      hc.Method,
+		TTL:         hc.TTL,
+		Nameservers: hc.Nameservers,
+	}
+}
 
+func (hc *HeClient) String() string {
+	return fmt.Sprintf("%+v", hc.MarshalLog())
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (hc *HeClient) AddTxtRecordWithLogin(ctx context.Context, ch *v1alpha1.ChallengeRequest) (err error) {
+
+	logger := klog.FromContext(ctx)
+	defer func() { hc.saveSnapshot(ctx, err) }()
 	rn, domain, key := getNDK(ch)
 
-	klog.InfoS("AddTxtRecordWithLogin", "rn", rn, "domain", domain, "key", key)
+	logger.Info("AddTxtRecordWithLogin", "rn", rn, "domain", domain, "key", key)
 
-	body, err := hc.doLogin()
+	body, err := hc.doLogin(ctx)
 	if err != nil {
 		return err
 	}
 
-	defer hc.doLogout()
+	defer hc.doLogout(ctx)
 
-	domainData, err := extractDomainData(body, domain)
+	domainData, err := extractDomainData(logger, body, domain)
 	if err != nil {
 		return err
 	}
 
 	//https://dns.he.net/?hosted_dns_zoneid=999999&menu=edit_zone&hosted_dns_editzone
 
-	klog.InfoS("Creating the TXT record", "rn", rn, "domain", domain, "key", key, "domainData", domainData)
+	logger.Info("Creating the TXT record", "rn", rn, "domain", domain, "key", key, "domainData", domainData)
+	defer func() { hc.audit(AuditCreate, domain, rn+"."+domain, "", err) }()
 
 	postData := url.Values{}
 	postData.Set("account", "")
@@ -62,10 +120,10 @@ func (hc *HeClient) AddTxtRecordWithLogin(ch *v1alpha1.ChallengeRequest) error {
 	postData.Set("Priority", "")
 	postData.Set("Name", rn)
 	postData.Set("Content", key)
-	postData.Set("TTL", "7200")
+	postData.Set("TTL", strconv.Itoa(hc.ttl()))
 	postData.Set("hosted_dns_editrecord", "Submit")
 
-	response, err := hc.Client.PostForm(hc.HeUrl+"index.cgi", postData)
+	response, err := hc.postForm(ctx, stepRecordPost, hc.HeUrl+"index.cgi", postData)
 	if err != nil {
 		return fmt.Errorf("error creating record: %v", err)
 	}
@@ -85,58 +143,41 @@ func (hc *HeClient) AddTxtRecordWithLogin(ch *v1alpha1.ChallengeRequest) error {
 	msg1 := fmt.Sprintf(">Successfully added new record to %v<", domain)
 	msg2 := ">Insert failed.  Unable to update.  That record already exists."
 	if !(strings.Contains(body, msg1) || strings.Contains(body, msg2)) {
-		return fmt.Errorf("cannot find the expected creation message in page")
+		return layoutErrorf("cannot find the expected creation message in page")
 	}
 
-	klog.InfoS("Successfully created record")
+	logger.Info("Successfully created record")
 	return nil
 
 }
 
-func (hc *HeClient) RemoveTxtRecordWithLogin(ch *v1alpha1.ChallengeRequest) error {
+func (hc *HeClient) RemoveTxtRecordWithLogin(ctx context.Context, ch *v1alpha1.ChallengeRequest) (err error) {
 
+	logger := klog.FromContext(ctx)
+	defer func() { hc.saveSnapshot(ctx, err) }()
 	rn, domain, key := getNDK(ch)
 
-	klog.InfoS("RemoveTxtRecordWithLogin", "rn", rn, "domain", domain, "key", key)
-
-	body, err := hc.doLogin()
-	if err != nil {
-		return err
-	}
-	defer hc.doLogout()
+	logger.Info("RemoveTxtRecordWithLogin", "rn", rn, "domain", domain, "key", key)
 
-	domainData, err := extractDomainData(body, domain)
+	body, err := hc.doLogin(ctx)
 	if err != nil {
 		return err
 	}
+	defer hc.doLogout(ctx)
 
-	//https://dns.he.net/?hosted_dns_zoneid=999999&menu=edit_zone&hosted_dns_editzone
-
-	newUrl := hc.HeUrl + domainData.targetLink
-
-	// we have to actually go there to get the record id
-	response, err := hc.Client.Get(newUrl)
-	if err != nil {
-		return err
-	}
-	body, err = readBody(response)
+	body, domainData, err := hc.openZone(ctx, body, domain)
 	if err != nil {
 		return err
 	}
 
-	// check that we're in the right page
-	wantedMsg := fmt.Sprintf(">Managing zone: %s<", domain)
-	if !strings.Contains(body, wantedMsg) {
-		return fmt.Errorf("cannot find the 'managing zone' message in page")
-	}
-
-	x, err := extractRecordId(body, rn, domain, key)
+	x, err := extractRecordId(logger, body, rn, domain, key)
 	if err != nil {
 		return err
 	}
 	domainData.hostedDnsRecordId = x
 
-	klog.InfoS("Deleting the TXT record", "rn", rn, "domain", domain, "key", key, "domainData", domainData)
+	logger.Info("Deleting the TXT record", "rn", rn, "domain", domain, "key", key, "domainData", domainData)
+	defer func() { hc.audit(AuditDelete, domain, rn+"."+domain, x, err) }()
 
 	postData := url.Values{}
 	postData.Set("hosted_dns_zoneid", domainData.hostedDnsZoneId)
@@ -146,7 +187,7 @@ func (hc *HeClient) RemoveTxtRecordWithLogin(ch *v1alpha1.ChallengeRequest) erro
 	postData.Set("hosted_dns_editzone", "1")
 	postData.Set("hosted_dns_delrecord", "1")
 
-	response, err = hc.Client.PostForm(hc.HeUrl+"index.cgi", postData)
+	response, err := hc.postForm(ctx, stepRecordPost, hc.HeUrl+"index.cgi", postData)
 	if err != nil {
 		return fmt.Errorf("error deleting record: %v", err)
 	}
@@ -162,75 +203,78 @@ func (hc *HeClient) RemoveTxtRecordWithLogin(ch *v1alpha1.ChallengeRequest) erro
 	}
 
 	// check that we're on the right page: there should be a ">Successfully removed record.<" message
-	wantedMsg = ">Successfully removed record.<"
+	wantedMsg := ">Successfully removed record.<"
 	if !strings.Contains(body, wantedMsg) {
-		return fmt.Errorf("cannot find the successful deletion message in page")
+		return layoutErrorf("cannot find the successful deletion message in page")
 	}
 
-	klog.InfoS("Successfully deleted record")
+	logger.Info("Successfully deleted record")
 
 	return nil
 
 }
 
-func (hc *HeClient) AddTxtRecordWithDynamicDns(ch *v1alpha1.ChallengeRequest) error {
+func (hc *HeClient) AddTxtRecordWithDynamicDns(ctx context.Context, ch *v1alpha1.ChallengeRequest) error {
 
+	logger := klog.FromContext(ctx)
 	rn, domain, key := getNDK(ch)
 
-	klog.InfoS("AddTxtRecordWithDynamicDns", "rn", rn, "domain", domain, "key", key)
-
-	//curl "https://dyn.dns.he.net/nic/update" -d "hostname=_acme-challenge.solartis.it" -d 'password=mychallenge' -d "txt=FOOBAR"
-
-	postData := url.Values{}
-	postData.Set("hostname", rn+"."+domain)
-	postData.Set("password", hc.ApiKey)
-	postData.Set("txt", key)
+	logger.Info("AddTxtRecordWithDynamicDns", "rn", rn, "domain", domain, "key", key)
 
-	response, err := hc.Client.PostForm(hc.HeUrl+"nic/update", postData)
+	err := hc.UpdateDynamicDns(ctx, rn+"."+domain, key)
+	hc.audit(AuditUpdate, domain, rn+"."+domain, "", err)
 	if err != nil {
-		return fmt.Errorf("submission error: %v", err)
+		return err
 	}
 
-	// to be successful, the response should start with either "good " or "nochg "
-	// status code 200
+	logger.Info("Successfully added record")
+	return nil
 
-	klog.V(4).InfoS("Dynamic DNS response", "status", response.Status, "headers", response.Header)
+}
 
-	body, err := readBody(response)
+func (hc *HeClient) RemoveTxtRecordWithDynamicDns(ctx context.Context, ch *v1alpha1.ChallengeRequest) error {
 
-	if err != nil {
-		return err
-	}
+	logger := klog.FromContext(ctx)
+	rn, domain, key := getNDK(ch)
 
-	if !(body[:5] == "good " || body[:6] == "nochg ") {
-		return fmt.Errorf("submission failed, response body is '%v'", body)
+	logger.Info("RemoveTxtRecordWithDynamicDns", "rn", rn, "domain", domain, "key", key)
+
+	// a newer challenge may have written its key already, so the record is
+	// only reset if it still has ours
+	if len(hc.Nameservers) > 0 {
+		values, err := currentTxt(ctx, hc.Nameservers, rn+"."+domain)
+		if err != nil {
+			logger.Error(err, "Cannot check the current value of the record, resetting it anyway", "rn", rn, "domain", domain)
+		} else if !contains(values, key) {
+			logger.Info("Not resetting the record, it no longer has our key", "rn", rn, "domain", domain, "values", values)
+			return nil
+		}
 	}
 
-	if response.StatusCode != 200 {
-		return fmt.Errorf("unexpected response status %v", response.StatusCode)
+	// we just overwrite the TXT with a dummy value;
+	// we could even do nothing at all, for that matter
+	err := hc.UpdateDynamicDns(ctx, rn+"."+domain, hc.placeholder())
+	hc.audit(AuditDelete, domain, rn+"."+domain, "", err)
+	if err != nil {
+		return err
 	}
 
-	klog.InfoS("Successfully added record")
+	logger.Info("Successfully deleted record")
 	return nil
-
 }
 
-func (hc *HeClient) RemoveTxtRecordWithDynamicDns(ch *v1alpha1.ChallengeRequest) error {
-
-	rn, domain, key := getNDK(ch)
-
-	klog.InfoS("RemoveTxtRecordWithDynamicDns", "rn", rn, "domain", domain, "key", key)
+// UpdateDynamicDns sets the value of a dynamic-dns TXT record, using the API key
+func (hc *HeClient) UpdateDynamicDns(ctx context.Context, fqdn string, value string) error {
 
+	logger := klog.FromContext(ctx)
 	//curl "https://dyn.dns.he.net/nic/update" -d "hostname=_acme-challenge.solartis.it" -d 'password=mychallenge' -d "txt=FOOBAR"
 
-	// we just overwrite the TXT with a dummy value;
-	// we could even do nothing at all, for that matter
 	postData := url.Values{}
-	postData.Set("hostname", rn+"."+domain)
+	postData.Set("hostname", fqdn)
 	postData.Set("password", hc.ApiKey)
-	postData.Set("txt", "UNUSED")
+	postData.Set("txt", value)
 
-	response, err := hc.Client.PostForm(hc.HeUrl+"nic/update", postData)
+	response, err := hc.postForm(ctx, stepNicUpdate, hc.HeUrl+"nic/update", postData)
 	if err != nil {
 		return fmt.Errorf("submission error: %v", err)
 	}
@@ -238,7 +282,7 @@ func (hc *HeClient) RemoveTxtRecordWithDynamicDns(ch *v1alpha1.ChallengeRequest)
 	// to be successful, the response should start with either "good " or "nochg "
 	// status code 200
 
-	klog.V(4).InfoS("Dynamic DNS response", "status", response.Status, "headers", response.Header)
+	logger.V(4).Info("Dynamic DNS response", "status", response.Status, "headers", response.Header)
 
 	body, err := readBody(response)
 
@@ -246,20 +290,44 @@ func (hc *HeClient) RemoveTxtRecordWithDynamicDns(ch *v1alpha1.ChallengeRequest)
 		return err
 	}
 
-	if !(body[:5] == "good " || body[:6] == "nochg ") {
-		err = fmt.Errorf("submission failed, response body is '%v'", body)
+	err = parseDynamicDnsResponse(fqdn, body)
+	dynamicDnsResults.WithLabelValues(dynamicDnsResultCode(body, err)).Inc()
+	if err != nil {
 		return err
 	}
 
 	if response.StatusCode != 200 {
-		err = fmt.Errorf("unexpected response status %v", response.StatusCode)
-		return err
+		return fmt.Errorf("unexpected response status %v", response.StatusCode)
 	}
 
-	klog.InfoS("Successfully deleted record")
 	return nil
 }
 
+// TTL for the records created in login mode
+func (hc *HeClient) ttl() int {
+	if hc.TTL == 0 {
+		return 7200
+	}
+	return hc.TTL
+}
+
+// value for reset dynamic-dns records
+func (hc *HeClient) placeholder() string {
+	if hc.Placeholder == "" {
+		return placeholderTxt
+	}
+	return hc.Placeholder
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // extract the record name, the domain, and the key from the request
 func getNDK(ch *v1alpha1.ChallengeRequest) (string, string, string) {
 
@@ -273,14 +341,67 @@ func getNDK(ch *v1alpha1.ChallengeRequest) (string, string, string) {
 	return rn, domain, ch.Key
 }
 
+// openZone goes to the page of a zone, given the page shown after login. It
+// returns the zone page and the zone data.
+func (hc *HeClient) openZone(ctx context.Context, body string, domain string) (string, *domainData, error) {
+
+	domainData, err := extractDomainData(klog.FromContext(ctx), body, domain)
+	if err != nil {
+		return "", nil, err
+	}
+
+	//https://dns.he.net/?hosted_dns_zoneid=999999&menu=edit_zone&hosted_dns_editzone
+
+	// we have to actually go there to get the record ids
+	response, err := hc.get(ctx, stepZonePage, hc.HeUrl+domainData.targetLink)
+	if err != nil {
+		return "", nil, err
+	}
+	body, err = readBody(response)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// check that we're in the right page
+	wantedMsg := fmt.Sprintf(">Managing zone: %s<", domain)
+	if !strings.Contains(body, wantedMsg) {
+		return "", nil, layoutErrorf("cannot find the 'managing zone' message in page")
+	}
+
+	return body, domainData, nil
+}
+
+// a TXT record as shown in a zone page
+type txtRecord struct {
+	id    string
+	name  string
+	value string
+}
+
 // find the HE record ID from a page
-func extractRecordId(body string, rn string, domain string, key string) (string, error) {
+func extractRecordId(logger klog.Logger, body string, rn string, domain string, key string) (string, error) {
 
-	klog.V(4).InfoS("extractRecordId looking for key", "key", key)
+	logger.V(4).Info("extractRecordId looking for key", "key", key)
+
+	records, err := parseTxtRecords(logger, body)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range records {
+		if r.name == rn+"."+domain && r.value == key {
+			return r.id, nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot find record to remove in zone")
+}
+
+// parseTxtRecords returns the TXT records listed in a zone page
+func parseTxtRecords(logger klog.Logger, body string) ([]txtRecord, error) {
 
 	tree, err := htmlquery.Parse(strings.NewReader(body))
 	if err != nil {
-		return "", fmt.Errorf("error parsing HTML body: %v", err)
+		return nil, layoutErrorf("error parsing HTML body: %v", err)
 	}
 
 	/*
@@ -306,63 +427,84 @@ func extractRecordId(body string, rn string, domain string, key string) (string,
 
 	// NOTE: the "tbody" isn't in the actual html, but since go's parser adds it,
 	// we must include it in the xpath
+	records := []txtRecord{}
 	for _, tr := range htmlquery.Find(tree, "//div[@id='dns_main_content']/table/tbody/tr[@class='dns_tr']") {
 
-		td := htmlquery.Find(tr, "./td[4]/span")[0]
+		td, err := findOne(tr, "./td[4]/span")
+		if err != nil {
+			return nil, err
+		}
 		recordType := htmlquery.SelectAttr(td, "data")
 
-		klog.V(4).InfoS("Reading record", "recordType", recordType)
+		logger.V(4).Info("Reading record", "recordType", recordType)
 
 		if recordType != "TXT" {
 			continue
 		}
 
-		td = htmlquery.Find(tr, "./td[7]")[0]
+		td, err = findOne(tr, "./td[7]")
+		if err != nil {
+			return nil, err
+		}
 
 		// apparently this does unescaping too
 		txtValue := htmlquery.SelectAttr(td, "data")
 		// remove quotes
 		txtValue = strings.Trim(txtValue, "\"")
 
-		td = htmlquery.Find(tr, "./td[@class='dns_delete']")[0]
+		td, err = findOne(tr, "./td[@class='dns_delete']")
+		if err != nil {
+			return nil, err
+		}
 		onclick := htmlquery.SelectAttr(td, "onclick")
 		m := regexp.MustCompile(`^event\.cancelBubble=true;deleteRecord\(\s*'([^']*)'\s*,\s*'([^']*)'\s*,\s*'([^']*)'\s*\)$`)
 		res := m.FindAllStringSubmatch(onclick, -1)
+		if len(res) == 0 {
+			return nil, layoutErrorf("cannot parse the delete action of record: %q", onclick)
+		}
 
 		recordId, recordName, recordType := res[0][1], res[0][2], res[0][3]
 
-		klog.V(4).InfoS("Parsed record info", "txtValue", txtValue, "recordId", recordId, "recordName", recordName, "recordType", recordType)
+		logger.V(4).Info("Parsed record info", "txtValue", txtValue, "recordId", recordId, "recordName", recordName, "recordType", recordType)
 
-		if !(recordName == rn+"."+domain && recordType == "TXT" && txtValue == key) {
+		if recordType != "TXT" {
 			continue
 		}
-
-		// found
-		return recordId, nil
+		records = append(records, txtRecord{id: recordId, name: recordName, value: txtValue})
 	}
 
-	return "", fmt.Errorf("cannot find record to remove in zone")
-
+	return records, nil
 }
 
-func extractDomainData(body string, domain string) (*domainData, error) {
+func extractDomainData(logger klog.Logger, body string, domain string) (*domainData, error) {
 
-	klog.V(4).InfoS("extractDomainData", "domain", domain)
+	logger.V(4).Info("extractDomainData", "domain", domain)
 
 	tree, err := htmlquery.Parse(strings.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("error parsing response body: %v", err)
+		return nil, layoutErrorf("error parsing response body: %v", err)
 	}
 
 	// look for wanted domains
 	targetLink := ""
 	hostedDnsZoneId := ""
+	if htmlquery.FindOne(tree, "//table[@id='domains_table']") == nil {
+		return nil, layoutErrorf("cannot find the domains table in page")
+	}
 	for _, tr := range htmlquery.Find(tree, "//table[@id='domains_table']/tbody/tr") {
-		d := htmlquery.InnerText(htmlquery.Find(tr, "./td[3]/span")[0])
+		span, err := findOne(tr, "./td[3]/span")
+		if err != nil {
+			return nil, err
+		}
+		d := htmlquery.InnerText(span)
 		if d != domain {
 			continue
 		}
-		href := htmlquery.SelectAttr(htmlquery.Find(tr, "./td[2]/img")[0], "onclick")
+		img, err := findOne(tr, "./td[2]/img")
+		if err != nil {
+			return nil, err
+		}
+		href := htmlquery.SelectAttr(img, "onclick")
 		m := regexp.MustCompile(`^javascript:document\.location\.href='(.*)'$`)
 		targetLink = m.ReplaceAllString(href, "$1")
 		m = regexp.MustCompile(`.*hosted_dns_zoneid=(\d+).*`)
@@ -371,7 +513,7 @@ func extractDomainData(body string, domain string) (*domainData, error) {
 	}
 
 	if targetLink == "" {
-		return nil, fmt.Errorf("requested domain %v not found", domain)
+		return nil, fmt.Errorf("requested domain %v not found: %w", domain, ErrZoneNotFound)
 	}
 
 	return &domainData{
@@ -380,10 +522,15 @@ func extractDomainData(body string, domain string) (*domainData, error) {
 	}, nil
 }
 
-func (hc *HeClient) doLogout() error {
-	// fetch initial page to get the cookie
-	klog.InfoS("Logging out...")
-	_, err := hc.Client.Get(hc.HeUrl + "?action=logout")
+func (hc *HeClient) doLogout(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	logger.Info("Logging out...")
+	heOpenSessions.Dec()
+	response, err := hc.get(ctx, stepLogout, hc.HeUrl+"?action=logout")
+	if err != nil {
+		return err
+	}
+	_, err = readBody(response)
 	return err
 }
 
@@ -399,43 +546,103 @@ func readBody(response *http.Response) (string, error) {
 
 }
 
-func (hc *HeClient) doLogin() (string, error) {
+func (hc *HeClient) doLogin(ctx context.Context) (string, error) {
 
+	logger := klog.FromContext(ctx)
 	if hc.Username == "" || hc.Password == "" {
 		return "", fmt.Errorf("empty username or password")
 	}
 
 	// fetch initial page to get the cookie
-	klog.InfoS("Fetching initial page", "url", hc.HeUrl)
-	_, err := hc.Client.Get(hc.HeUrl)
+	logger.Info("Fetching initial page", "url", hc.HeUrl)
+	response, err := hc.get(ctx, stepInitialPage, hc.HeUrl)
 
 	if err != nil {
+		heLogins.WithLabelValues("error").Inc()
 		return "", fmt.Errorf("error fetching initial page '%v': %v", hc.HeUrl, err)
 	}
+	if _, err := readBody(response); err != nil {
+		heLogins.WithLabelValues("error").Inc()
+		return "", err
+	}
 
-	klog.InfoS("Logging in", "username", hc.Username)
+	logger.Info("Logging in", "username", hc.Username)
 	postData := url.Values{}
 	postData.Set("email", hc.Username)
 	postData.Set("pass", hc.Password)
 	postData.Set("submit", "Login!")
 
-	response, err := hc.Client.PostForm(hc.HeUrl, postData)
+	response, err = hc.postForm(ctx, stepLogin, hc.HeUrl, postData)
 	if err != nil {
+		heLogins.WithLabelValues("error").Inc()
 		return "", fmt.Errorf("login error: %v", err)
 	}
 
-	klog.V(4).InfoS("Login response", "status", response.Status, "headers", response.Header)
+	logger.V(4).Info("Login response", "status", response.Status, "headers", response.Header)
 
 	body, err := readBody(response)
 
 	if err != nil {
+		heLogins.WithLabelValues("error").Inc()
 		return "", err
 	}
 
 	if strings.Contains(body, ">Incorrect</div>") {
-		err = fmt.Errorf("login failed (invalid credentials?)")
+		heLogins.WithLabelValues("invalid_credentials").Inc()
+		return "", ErrLoginFailed
+	}
+
+	if isTotpPage(body) {
+		body, err = hc.doTotp(ctx)
+		if err != nil {
+			heLogins.WithLabelValues("totp_failed").Inc()
+			return "", err
+		}
+	}
+
+	heLogins.WithLabelValues("success").Inc()
+	heOpenSessions.Inc()
+	return body, nil
+}
+
+// the one-time code page shown to accounts with two-factor authentication
+// enabled has a form with a "tfacode" input
+func isTotpPage(body string) bool {
+	return strings.Contains(body, `name="tfacode"`)
+}
+
+func (hc *HeClient) doTotp(ctx context.Context) (string, error) {
+
+	logger := klog.FromContext(ctx)
+	if hc.TotpSecret == "" {
+		return "", fmt.Errorf("login requires a one-time code, but no TOTP secret is configured")
+	}
+
+	code, err := generateTotp(hc.TotpSecret, time.Now())
+	if err != nil {
 		return "", err
 	}
 
+	logger.Info("Submitting one-time code", "username", hc.Username)
+	postData := url.Values{}
+	postData.Set("tfacode", code)
+	postData.Set("submit", "Submit")
+
+	response, err := hc.postForm(ctx, stepTotp, hc.HeUrl, postData)
+	if err != nil {
+		return "", fmt.Errorf("one-time code submission error: %v", err)
+	}
+
+	logger.V(4).Info("One-time code response", "status", response.Status, "headers", response.Header)
+
+	body, err := readBody(response)
+	if err != nil {
+		return "", err
+	}
+
+	if isTotpPage(body) || strings.Contains(body, ">Incorrect</div>") {
+		return "", fmt.Errorf("two-factor authentication failed (wrong TOTP secret or clock skew?)")
+	}
+
 	return body, nil
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// errInvalidConfig is returned (wrapped) for solver configs with problems
+var errInvalidConfig = errors.New("invalid solver config")
+
+// configProblems collects all the problems found in a solver config, so they
+// can be reported together
+type configProblems []string
+
+func (p *configProblems) add(path string, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if path != "" {
+		msg = path + ": " + msg
+	}
+	*p = append(*p, msg)
+}
+
+func (p configProblems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", errInvalidConfig, strings.Join(p, "; "))
+}
+
+// checkFields reports the keys in data that don't correspond to a field of
+// t (recursively). Like encoding/json, keys are matched case-insensitively,
+// so both the legacy `ApiKeySecretRef` and `apiKeySecretRef` are accepted,
+// but setting the same field twice with different spellings is an error.
+func checkFields(data json.RawMessage, t reflect.Type, path string, problems *configProblems) {
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj := map[string]json.RawMessage{}
+		if err := json.Unmarshal(data, &obj); err != nil {
+			// wrong types are reported when decoding
+			return
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		seen := map[string]string{}
+		for _, key := range keys {
+			value := obj[key]
+			field, name, ok := jsonField(t, key)
+			if !ok {
+				msg := fmt.Sprintf("unknown field %q", key)
+				if suggestion := suggestField(t, key); suggestion != "" {
+					msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+				}
+				problems.add(path, "%s", msg)
+				continue
+			}
+			if other, dup := seen[name]; dup {
+				problems.add(path, "both %q and %q are set, use only one", other, key)
+				continue
+			}
+			seen[name] = key
+			checkFields(value, field.Type, joinPath(path, key), problems)
+		}
+
+	case reflect.Slice:
+		elems := []json.RawMessage{}
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return
+		}
+		for i, elem := range elems {
+			checkFields(elem, t.Elem(), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	}
+}
+
+// jsonField finds the field of t matching the given JSON key
+func jsonField(t reflect.Type, key string) (reflect.StructField, string, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if strings.EqualFold(name, key) {
+			return f, name, true
+		}
+	}
+	return reflect.StructField{}, "", false
+}
+
+// suggestField returns the field name closest to an unknown key, if any is
+// close enough to be a plausible typo
+func suggestField(t reflect.Type, key string) string {
+	best, bestDistance := "", 4
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if d := editDistance(strings.ToLower(name), strings.ToLower(key)); d < bestDistance {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+// Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// check reports the inconsistencies in a decoded solver config. defaultMethod
+// is the method used when the config doesn't set one.
+func (cfg *heProviderConfig) check(defaultMethod string, problems *configProblems) {
+	validateSolverSettings(cfg.Method, defaultMethod, cfg.HeUrl, cfg.CredentialsSecretRef, cfg.ApiKeySecretRef, cfg.CredentialProvider, cfg.Exec, "", problems)
+
+	// the credential providers the fallbacks may run with: the top-level
+	// one, or the one of each account
+	type providerSettings struct {
+		provider string
+		exec     execConfig
+	}
+	providers := []providerSettings{{cfg.CredentialProvider, cfg.Exec}}
+	if len(cfg.Accounts) > 0 {
+		providers = nil
+	}
+
+	zones := map[string]int{}
+	for i, account := range cfg.Accounts {
+		path := fmt.Sprintf("accounts[%d]", i)
+		if len(account.Zones) == 0 {
+			problems.add(path, "at least one zone must be listed")
+		}
+		for _, z := range account.Zones {
+			z = strings.ToLower(strings.TrimSuffix(z, "."))
+			if z == "" || z == "." {
+				problems.add(path, "empty zone")
+				continue
+			}
+			if other, dup := zones[z]; dup {
+				problems.add(path, "zone %q is also listed in accounts[%d]", z, other)
+			}
+			zones[z] = i
+		}
+
+		// unset account values are inherited from the top level
+		method := account.Method
+		if method == "" && validMethod(cfg.Method) {
+			method = cfg.Method
+		}
+		provider := account.CredentialProvider
+		if provider == "" {
+			provider = cfg.CredentialProvider
+		}
+		// the top-level exec settings are only used by accounts that run exec
+		execCfg := account.Exec
+		if execCfg.Plugin == "" && len(execCfg.Args) == 0 && provider == "exec" {
+			execCfg = cfg.Exec
+		}
+		validateSolverSettings(method, defaultMethod, account.HeUrl, account.CredentialsSecretRef, account.ApiKeySecretRef, provider, execCfg, path, problems)
+		providers = append(providers, providerSettings{provider, execCfg})
+	}
+	if len(cfg.Accounts) > 0 && (cfg.CredentialsSecretRef != secretRef{} || cfg.ApiKeySecretRef != secretRef{}) {
+		problems.add("", "secret references must be given inside each account when accounts are used")
+	}
+
+	method := cfg.Method
+	if method == "" {
+		method = defaultMethod
+	}
+	if len(cfg.Fallback) > 0 && method != "login" && method != "auto" {
+		problems.add("fallback", "only applies to the login and auto methods")
+	}
+	for i, fb := range cfg.Fallback {
+		path := fmt.Sprintf("fallback[%d]", i)
+		if fb.Method != "" && fb.Method != "dynamic-dns" {
+			problems.add(joinPath(path, "method"), "invalid fallback method '%v', the only valid value is 'dynamic-dns'", fb.Method)
+		}
+		// reported once even if several accounts have the same problem
+		seen := map[string]bool{}
+		for _, p := range providers {
+			fbProblems := configProblems{}
+			validateSolverSettings("dynamic-dns", defaultMethod, fb.HeUrl, secretRef{}, fb.ApiKeySecretRef, p.provider, p.exec, path, &fbProblems)
+			for _, msg := range fbProblems {
+				if !seen[msg] {
+					seen[msg] = true
+					*problems = append(*problems, msg)
+				}
+			}
+		}
+	}
+}
+
+func validMethod(method string) bool {
+	return method == "" || method == "login" || method == "dynamic-dns" || method == "auto"
+}
+
+// checks shared by the top level config and the accounts
+func validateSolverSettings(method, defaultMethod, heUrl string, credentialsRef, apiKeyRef secretRef, provider string, execCfg execConfig, path string, problems *configProblems) {
+
+	if !validMethod(method) {
+		problems.add(joinPath(path, "method"), "invalid configuration method '%v', valid values are 'login', 'dynamic-dns' or 'auto'", method)
+	}
+	if method == "" {
+		method = defaultMethod
+	}
+
+	if heUrl != "" {
+		if err := validateUrl(heUrl); err != nil {
+			problems.add(joinPath(path, "heUrl"), "%v", err)
+		}
+	}
+
+	if method == "login" {
+		if apiKeyRef != (secretRef{}) {
+			problems.add(joinPath(path, "apiKeySecretRef"), "cannot be used with the login method, use credentialsSecretRef")
+		}
+		if credentialsRef.ApiKeyKey != "" {
+			problems.add(joinPath(path, "credentialsSecretRef.apiKeyKey"), "only applies to the dynamic-dns method")
+		}
+	}
+	if method == "auto" && credentialsRef != (secretRef{}) && apiKeyRef != (secretRef{}) {
+		problems.add(path, "with the auto method, give either credentialsSecretRef or apiKeySecretRef, not both")
+	}
+	if method == "dynamic-dns" {
+		if credentialsRef != (secretRef{}) {
+			problems.add(joinPath(path, "credentialsSecretRef"), "cannot be used with the dynamic-dns method, use apiKeySecretRef")
+		}
+		if apiKeyRef.UsernameKey != "" || apiKeyRef.PasswordKey != "" || apiKeyRef.TotpSecretKey != "" {
+			problems.add(joinPath(path, "apiKeySecretRef"), "usernameKey, passwordKey and totpSecretKey only apply to the login method")
+		}
+	}
+
+	switch provider {
+	case "", "env", "secret", "file", "exec":
+	default:
+		problems.add(joinPath(path, "credentialProvider"), "invalid credential provider '%v', valid values are 'env', 'secret', 'file' or 'exec'", provider)
+	}
+	if provider != "" && provider != "secret" && (credentialsRef != secretRef{} || apiKeyRef != secretRef{}) {
+		problems.add(path, "secret references cannot be used with the %v credential provider", provider)
+	}
+	if provider == "exec" && execCfg.Plugin == "" {
+		problems.add(joinPath(path, "exec.plugin"), "must be set when using the exec credential provider")
+	}
+	if provider != "exec" && (execCfg.Plugin != "" || len(execCfg.Args) > 0) {
+		problems.add(joinPath(path, "exec"), "can only be used with the exec credential provider")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+)
+
+func TestLoadConfigFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// substrings of the error, none if the config is valid
+		wantErr []string
+	}{
+		{
+			name:   "legacy spelling",
+			config: `{"method": "dynamic-dns", "ApiKeySecretRef": {"name": "ddns"}}`,
+		},
+		{
+			name:   "any case",
+			config: `{"METHOD": "dynamic-dns", "apikeysecretref": {"NAME": "ddns", "apiKEYkey": "key"}}`,
+		},
+		{
+			name:    "both spellings",
+			config:  `{"method": "dynamic-dns", "ApiKeySecretRef": {"name": "a"}, "apiKeySecretRef": {"name": "b"}}`,
+			wantErr: []string{`both "ApiKeySecretRef" and "apiKeySecretRef" are set`},
+		},
+		{
+			name:    "typo with suggestion",
+			config:  `{"metod": "login"}`,
+			wantErr: []string{`unknown field "metod" (did you mean "method"?)`},
+		},
+		{
+			name:    "nested typo",
+			config:  `{"credentialsSecretRef": {"nmae": "he"}}`,
+			wantErr: []string{`credentialsSecretRef: unknown field "nmae" (did you mean "name"?)`},
+		},
+		{
+			name:    "typo in a list",
+			config:  `{"accounts": [{"zones": ["example.com"]}, {"zone": ["example.org"]}]}`,
+			wantErr: []string{`accounts[1]: unknown field "zone" (did you mean "zones"?)`},
+		},
+		{
+			name:    "no plausible suggestion",
+			config:  `{"somethingElse": true}`,
+			wantErr: []string{`unknown field "somethingElse"`},
+		},
+		{
+			name:    "all problems together",
+			config:  `{"metod": "login", "heUrl": "dns.he.net", "method": "magic"}`,
+			wantErr: []string{"metod", "heUrl", "magic"},
+		},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(&extapi.JSON{Raw: []byte(tt.config)}, "login")
+		if len(tt.wantErr) == 0 {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, errInvalidConfig) {
+			t.Errorf("%v: got %v, want an invalid config error", tt.name, err)
+			continue
+		}
+		for _, want := range tt.wantErr {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%v: got %v, want it to mention %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "login", config: `{"method": "login", "credentialsSecretRef": {"name": "he"}}`},
+		{name: "api key with login", config: `{"method": "login", "apiKeySecretRef": {"name": "ddns"}}`, wantErr: "apiKeySecretRef: cannot be used with the login method"},
+		{name: "api key with default login", config: `{"apiKeySecretRef": {"name": "ddns"}}`, wantErr: "cannot be used with the login method"},
+		{name: "credentials with dynamic-dns", config: `{"method": "dynamic-dns", "credentialsSecretRef": {"name": "he"}}`, wantErr: "cannot be used with the dynamic-dns method"},
+		{name: "auto with both refs", config: `{"method": "auto", "credentialsSecretRef": {"name": "he"}, "apiKeySecretRef": {"name": "ddns"}}`, wantErr: "not both"},
+		{name: "exec without plugin", config: `{"credentialProvider": "exec"}`, wantErr: "exec.plugin: must be set"},
+		{name: "plugin without exec", config: `{"exec": {"plugin": "vault"}}`, wantErr: "can only be used with the exec credential provider"},
+		{name: "secret ref with env", config: `{"credentialProvider": "env", "credentialsSecretRef": {"name": "he"}}`, wantErr: "cannot be used with the env credential provider"},
+		{name: "duplicate zone", config: `{"accounts": [{"zones": ["example.com"]}, {"zones": ["Example.com."]}]}`, wantErr: `zone "example.com" is also listed in accounts[0]`},
+		{name: "account without zones", config: `{"accounts": [{"method": "login"}]}`, wantErr: "accounts[0]: at least one zone"},
+		{name: "refs outside accounts", config: `{"credentialsSecretRef": {"name": "he"}, "accounts": [{"zones": ["example.com"]}]}`, wantErr: "inside each account"},
+		{name: "account inherits exec", config: `{"credentialProvider": "exec", "exec": {"plugin": "vault"}, "accounts": [{"zones": ["example.com"]}]}`},
+		{name: "fallback with dynamic-dns", config: `{"method": "dynamic-dns", "fallback": [{}]}`, wantErr: "fallback: only applies to the login and auto methods"},
+		{name: "fallback method", config: `{"fallback": [{"method": "login"}]}`, wantErr: "fallback[0].method"},
+	}
+	for _, tt := range tests {
+		_, err := loadConfig(&extapi.JSON{Raw: []byte(tt.config)}, "login")
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%v: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%v: got %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSuggestField(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"metod", "method"},
+		{"HEURL", "heUrl"},
+		{"credentialSecretRef", "credentialsSecretRef"},
+		{"apikeysecret", "ApiKeySecretRef"},
+		{"fallbacks", "fallback"},
+		{"somethingElse", ""},
+		{"zzzz", ""},
+	}
+	for _, tt := range tests {
+		if got := suggestField(reflect.TypeOf(heProviderConfig{}), tt.key); got != tt.want {
+			t.Errorf("suggestField(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"method", "method", 0},
+		{"metod", "method", 1},
+		{"mehtod", "method", 2},
+		{"", "abc", 3},
+		{"kitten", "sitting", 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// watchFiles calls onChange whenever something changes in the directories
+// containing the given files, until stopCh is closed.
+// The directories are watched rather than the files themselves, since the
+// kubelet updates mounted volumes by atomically swapping a symlink, which a
+// watch on the file would not see.
+func watchFiles(paths []string, stopCh <-chan struct{}, onChange func()) error {
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating file watcher: %v", err)
+	}
+
+	dirs := map[string]bool{}
+	for _, path := range paths {
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("error watching directory %v: %v", dir, err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				klog.V(4).InfoS("Watched directory changed", "event", event.String())
+				onChange()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				klog.ErrorS(err, "Error watching files")
+			}
+		}
+	}()
+
+	return nil
+}